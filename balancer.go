@@ -0,0 +1,102 @@
+package spider
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/ywanbing/spider/message"
+)
+
+// Balancer 连接池的负载均衡策略，为每个请求选择一个客户端
+type Balancer interface {
+	// Pick 从 clients 中选择处理 req 的客户端，clients 不为空，并且都处于 Ready 状态。
+	// 可能被并发调用。
+	Pick(clients []*TcpClient, req message.Message) *TcpClient
+}
+
+// roundRobinBalancer 轮流选择客户端
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+// NewRoundRobinBalancer 创建轮询的负载均衡策略
+func NewRoundRobinBalancer() Balancer {
+	return new(roundRobinBalancer)
+}
+
+func (b *roundRobinBalancer) Pick(clients []*TcpClient, req message.Message) *TcpClient {
+	return clients[(b.next.Add(1)-1)%uint64(len(clients))]
+}
+
+// leastPendingBalancer 选择未结束的调用最少的客户端
+type leastPendingBalancer struct {
+	// 数量相同时轮流选择
+	rr roundRobinBalancer
+}
+
+// NewLeastPendingBalancer 创建选择未结束的调用最少的客户端的负载均衡策略
+func NewLeastPendingBalancer() Balancer {
+	return new(leastPendingBalancer)
+}
+
+func (b *leastPendingBalancer) Pick(clients []*TcpClient, req message.Message) *TcpClient {
+	offset := int(b.rr.next.Add(1) - 1)
+	var (
+		picked *TcpClient
+		least  int
+	)
+	for i := range clients {
+		c := clients[(offset+i)%len(clients)]
+		if n := c.Pending(); picked == nil || n < least {
+			picked, least = c, n
+		}
+	}
+	return picked
+}
+
+// consistentHashBalancer 按照请求头 key 的值选择客户端，值相同的请求发送到同一个地址
+type consistentHashBalancer struct {
+	key string
+	// 请求没有 key 时轮流选择
+	rr roundRobinBalancer
+}
+
+// NewConsistentHashBalancer 创建按照请求头 key 一致性哈希的负载均衡策略。
+// 使用最高随机权重（rendezvous）哈希，地址增减时只影响该地址上的 key。
+// 同一个地址有多个连接时，再按照哈希值选择连接。
+func NewConsistentHashBalancer(key string) Balancer {
+	return &consistentHashBalancer{key: key}
+}
+
+func (b *consistentHashBalancer) Pick(clients []*TcpClient, req message.Message) *TcpClient {
+	value, ok := req.GetHeader()[b.key]
+	if !ok {
+		return b.rr.Pick(clients, req)
+	}
+
+	addr, best := clients[0].Addr(), hashOf(value, clients[0].Addr())
+	for _, c := range clients[1:] {
+		if c.Addr() == addr {
+			continue
+		}
+		if score := hashOf(value, c.Addr()); score > best {
+			addr, best = c.Addr(), score
+		}
+	}
+
+	picked := make([]*TcpClient, 0, 1)
+	for _, c := range clients {
+		if c.Addr() == addr {
+			picked = append(picked, c)
+		}
+	}
+	return picked[hashOf(value, "")%uint64(len(picked))]
+}
+
+func hashOf(key, addr string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(addr))
+	return h.Sum64()
+}
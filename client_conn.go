@@ -0,0 +1,147 @@
+package spider
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/common"
+	"github.com/ywanbing/spider/message"
+	"github.com/ywanbing/spider/proto"
+)
+
+// clientConn 客户端当前的连接，重连后原子地替换，方法调用转发给调用时的连接。
+// 还没有建立连接时，发送和关闭返回 code.ErrConnClosed。
+type clientConn struct {
+	cur atomic.Pointer[TcpConn]
+}
+
+var _ TcpConn = new(clientConn)
+
+// get 返回当前的连接，还没有建立连接时返回 nil
+func (c *clientConn) get() TcpConn {
+	if p := c.cur.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+func (c *clientConn) set(conn TcpConn) {
+	c.cur.Store(&conn)
+}
+
+func (c *clientConn) Pack(m message.Message) ([]byte, error) {
+	return c.get().Pack(m)
+}
+
+func (c *clientConn) Unpack(data []byte) (message.Message, error) {
+	return c.get().Unpack(data)
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	if conn := c.get(); conn != nil {
+		return conn.Read(b)
+	}
+	return 0, code.ErrConnClosed
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	if conn := c.get(); conn != nil {
+		return conn.Write(b)
+	}
+	return 0, code.ErrConnClosed
+}
+
+func (c *clientConn) Close() error {
+	if conn := c.get(); conn != nil {
+		return conn.Close()
+	}
+	return code.ErrConnClosed
+}
+
+func (c *clientConn) LocalAddr() net.Addr {
+	return c.get().LocalAddr()
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	return c.get().RemoteAddr()
+}
+
+func (c *clientConn) SetDeadline(t time.Time) error {
+	return c.get().SetDeadline(t)
+}
+
+func (c *clientConn) SetReadDeadline(t time.Time) error {
+	return c.get().SetReadDeadline(t)
+}
+
+func (c *clientConn) SetWriteDeadline(t time.Time) error {
+	return c.get().SetWriteDeadline(t)
+}
+
+func (c *clientConn) GetConnId() uint64 {
+	return c.get().GetConnId()
+}
+
+func (c *clientConn) SetConnId(id uint64) {
+	c.get().SetConnId(id)
+}
+
+func (c *clientConn) Handshake() error {
+	return c.get().Handshake()
+}
+
+func (c *clientConn) Negotiated() *proto.Negotiated {
+	return c.get().Negotiated()
+}
+
+func (c *clientConn) GetProto() proto.Proto {
+	return c.get().GetProto()
+}
+
+func (c *clientConn) Start() {
+	c.get().Start()
+}
+
+func (c *clientConn) SendMsg(m message.Message) error {
+	if conn := c.get(); conn != nil {
+		return conn.SendMsg(m)
+	}
+	return code.ErrConnClosed
+}
+
+func (c *clientConn) SendMsgCtx(ctx context.Context, m message.Message) error {
+	if conn := c.get(); conn != nil {
+		return conn.SendMsgCtx(ctx, m)
+	}
+	return code.ErrConnClosed
+}
+
+func (c *clientConn) SendFrame(f *common.Frame) error {
+	if conn := c.get(); conn != nil {
+		return conn.SendFrame(f)
+	}
+	f.Release()
+	return code.ErrConnClosed
+}
+
+func (c *clientConn) NewStream(ctx context.Context, msgId uint32) (*Stream, error) {
+	if conn := c.get(); conn != nil {
+		return conn.NewStream(ctx, msgId)
+	}
+	return nil, code.ErrConnClosed
+}
+
+func (c *clientConn) SetSlowConsumerPolicy(policy SlowConsumerPolicy, timeout time.Duration) {
+	c.get().SetSlowConsumerPolicy(policy, timeout)
+}
+
+func (c *clientConn) StopNotifyChan() chan struct{} {
+	return c.get().StopNotifyChan()
+}
+
+func (c *clientConn) CloseReason() error {
+	return c.get().CloseReason()
+}
@@ -0,0 +1,360 @@
+package spider
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+)
+
+type poolConfig struct {
+	// 每个地址的连接数量。默认值：1。
+	size int
+	// 负载均衡策略。默认值：NewRoundRobinBalancer()。
+	balancer Balancer
+	// 创建连接的配置
+	connOptions []ConnConfigOption
+	// 替换连接失败后的重试策略，不会放弃。默认值：10ms 开始翻倍，最长 5s。
+	replacePolicy ReconnectPolicy
+	// 服务发现，不为空时忽略 NewClientPool 传入的地址
+	resolver Resolver
+}
+
+type PoolOption func(poolConfig) poolConfig
+
+// WithPoolSize sets the number of connections to each address.
+// default: 1
+func WithPoolSize(size int) PoolOption {
+	return func(cfg poolConfig) poolConfig {
+		if size > 0 {
+			cfg.size = size
+		}
+		return cfg
+	}
+}
+
+// WithBalancer sets the load balancer of the pool.
+// default: NewRoundRobinBalancer()
+func WithBalancer(b Balancer) PoolOption {
+	return func(cfg poolConfig) poolConfig {
+		if b != nil {
+			cfg.balancer = b
+		}
+		return cfg
+	}
+}
+
+// WithPoolConnOptions sets the config options of every connection in the pool.
+func WithPoolConnOptions(opts ...ConnConfigOption) PoolOption {
+	return func(cfg poolConfig) poolConfig {
+		cfg.connOptions = append(cfg.connOptions, opts...)
+		return cfg
+	}
+}
+
+// WithResolver sets the resolver of the pool. The pool connects to the resolved
+// addresses instead of the static ones, and reconciles its connections when the
+// address set changes.
+func WithResolver(r Resolver) PoolOption {
+	return func(cfg poolConfig) poolConfig {
+		cfg.resolver = r
+		return cfg
+	}
+}
+
+// ClientPool 连接池，和每个地址保持多个连接，每个请求按照 Balancer 选择一个 Ready 的连接。
+// 连接放弃重连后在后台被替换。所有连接共用连接池的路由和中间件。
+type ClientPool struct {
+	cfg poolConfig
+	mux *Mux
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// 启动时连接的地址
+	targets []string
+
+	mu sync.RWMutex
+	// 已经连接的地址，按照地址排序，保证负载均衡的顺序稳定
+	addrs   []string
+	members map[string]*poolMember
+}
+
+// poolMember 同一个地址的连接
+type poolMember struct {
+	// 由 ClientPool.mu 保护
+	clients []*TcpClient
+	cancel  context.CancelFunc
+}
+
+func NewClientPool(addrs []string, opts ...PoolOption) *ClientPool {
+	cfg := poolConfig{
+		size:     1,
+		balancer: NewRoundRobinBalancer(),
+		replacePolicy: &BackoffPolicy{
+			Initial:    10 * time.Millisecond,
+			Max:        5 * time.Second,
+			Multiplier: 2,
+			Jitter:     true,
+		},
+	}
+	for _, opt := range opts {
+		cfg = opt(cfg)
+	}
+
+	p := &ClientPool{
+		cfg:     cfg,
+		mux:     newMux(),
+		targets: append([]string(nil), addrs...),
+		members: make(map[string]*poolMember),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p
+}
+
+// Start 建立所有的连接，只能调用一次。所有连接都失败时关闭连接池并返回最后一个错误。
+// 失败的连接在后台重试。
+func (p *ClientPool) Start() error {
+	if p.cfg.resolver != nil {
+		addrs, err := p.cfg.resolver.Resolve(p.ctx)
+		if err != nil {
+			p.Close()
+			return err
+		}
+		p.targets = addrs
+	}
+
+	var (
+		ready   bool
+		lastErr error = code.ErrNoAvailableConn
+	)
+	for _, addr := range p.targets {
+		for _, err := range p.add(addr) {
+			if err == nil {
+				ready = true
+			} else {
+				lastErr = err
+			}
+		}
+	}
+	if !ready {
+		p.Close()
+		return lastErr
+	}
+
+	if p.cfg.resolver != nil {
+		go p.watch(p.cfg.resolver.Watch(p.ctx))
+	}
+	return nil
+}
+
+// watch 地址列表变化后调整连接
+func (p *ClientPool) watch(updates <-chan []string) {
+	for addrs := range updates {
+		if len(addrs) == 0 {
+			// 避免服务发现出错时关闭所有的连接
+			// TODO log
+			continue
+		}
+		p.reconcile(addrs)
+	}
+}
+
+// reconcile 关闭不在 addrs 中的地址的连接，并建立到新地址的连接
+func (p *ClientPool) reconcile(addrs []string) {
+	want := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		want[addr] = true
+	}
+
+	p.mu.RLock()
+	current := append([]string(nil), p.addrs...)
+	p.mu.RUnlock()
+
+	for _, addr := range current {
+		if !want[addr] {
+			p.remove(addr)
+		}
+		delete(want, addr)
+	}
+	for _, addr := range addrs {
+		if want[addr] {
+			// 连接失败时在后台重试
+			p.add(addr)
+		}
+	}
+}
+
+// Close 关闭连接池和所有的连接
+func (p *ClientPool) Close() {
+	p.cancel()
+
+	p.mu.Lock()
+	addrs := append([]string(nil), p.addrs...)
+	p.mu.Unlock()
+	for _, addr := range addrs {
+		p.remove(addr)
+	}
+}
+
+// add 建立到 addr 的连接并在后台维护，返回每个连接第一次建立的结果，地址已经存在时返回 nil
+func (p *ClientPool) add(addr string) []error {
+	ctx, cancel := context.WithCancel(p.ctx)
+	m := &poolMember{clients: make([]*TcpClient, p.cfg.size), cancel: cancel}
+
+	p.mu.Lock()
+	if _, ok := p.members[addr]; ok || p.ctx.Err() != nil {
+		p.mu.Unlock()
+		cancel()
+		return nil
+	}
+	for i := range m.clients {
+		m.clients[i] = p.newClient(addr)
+	}
+	p.members[addr] = m
+	p.addrs = append(p.addrs, addr)
+	sort.Strings(p.addrs)
+	p.mu.Unlock()
+
+	errs := make([]error, len(m.clients))
+	for i, client := range m.clients {
+		errs[i] = client.Start()
+		go p.maintain(ctx, addr, m, i, client, errs[i])
+	}
+	return errs
+}
+
+// remove 关闭到 addr 的所有连接
+func (p *ClientPool) remove(addr string) {
+	p.mu.Lock()
+	m, ok := p.members[addr]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.members, addr)
+	for i, a := range p.addrs {
+		if a == addr {
+			p.addrs = append(p.addrs[:i], p.addrs[i+1:]...)
+			break
+		}
+	}
+	clients := append([]*TcpClient(nil), m.clients...)
+	p.mu.Unlock()
+
+	m.cancel()
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+func (p *ClientPool) newClient(addr string) *TcpClient {
+	client := NewTcpClient(addr, p.cfg.connOptions...)
+	client.mux = p.mux
+	return client
+}
+
+// maintain 等待连接关闭（放弃重连或者断开后不再重连）后替换为新的连接，err 为连接启动的结果
+func (p *ClientPool) maintain(ctx context.Context, addr string, m *poolMember, slot int, client *TcpClient, err error) {
+	defer func() {
+		client.Close()
+	}()
+
+	for attempt := 0; ; {
+		if err == nil {
+			attempt = 0
+			waitForShutdown(ctx, client)
+		} else {
+			attempt++
+			delay, _ := p.cfg.replacePolicy.Next(attempt, 0)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+		client.Close()
+		if ctx.Err() != nil {
+			return
+		}
+
+		client = p.newClient(addr)
+		p.mu.Lock()
+		m.clients[slot] = client
+		p.mu.Unlock()
+		err = client.Start()
+	}
+}
+
+// waitForShutdown 等待客户端不再可用：已经关闭，或者连接断开后不再重连
+func waitForShutdown(ctx context.Context, client *TcpClient) {
+	for state := client.State(); state != Shutdown && state != Idle; state = client.State() {
+		if !client.WaitForStateChange(ctx, state) {
+			return
+		}
+	}
+}
+
+// pick 按照负载均衡策略选择一个 Ready 的连接
+func (p *ClientPool) pick(req message.Message) (*TcpClient, error) {
+	p.mu.RLock()
+	ready := make([]*TcpClient, 0, len(p.addrs)*p.cfg.size)
+	for _, addr := range p.addrs {
+		for _, client := range p.members[addr].clients {
+			if client.State() == Ready {
+				ready = append(ready, client)
+			}
+		}
+	}
+	p.mu.RUnlock()
+
+	if len(ready) == 0 {
+		return nil, code.ErrNoAvailableConn
+	}
+	return p.cfg.balancer.Pick(ready, req), nil
+}
+
+// Call 选择一个连接发送请求，参见 TcpClient.Call
+func (p *ClientPool) Call(c context.Context, req message.Message) (message.Message, error) {
+	client, err := p.pick(req)
+	if err != nil {
+		return nil, err
+	}
+	return client.Call(c, req)
+}
+
+// Go 选择一个连接异步发送请求，参见 TcpClient.Go
+func (p *ClientPool) Go(c context.Context, req message.Message, done chan *Call) *Call {
+	client, err := p.pick(req)
+	if err != nil {
+		call := newCall(req, done)
+		call.Error = err
+		call.done()
+		return call
+	}
+	return client.Go(c, req, done)
+}
+
+// RegisterGlobalMiddle add client middle handlers of all connections.
+func (p *ClientPool) RegisterGlobalMiddle(middles ...func(ctx *Context)) {
+	p.mux.RegisterGlobalMiddle(middles...)
+}
+
+// RegisterModelMiddle add push routing middle handlers by modelID.
+func (p *ClientPool) RegisterModelMiddle(id modelID, middles ...func(ctx *Context)) {
+	p.mux.RegisterModelMiddle(id, middles...)
+}
+
+// RegisterHandler add push routing handlers by modelID and subMsgID.
+func (p *ClientPool) RegisterHandler(id modelID, subID subMsgID, handler func(ctx *Context), middles ...func(ctx *Context)) {
+	p.mux.RegisterHandler(id, subID, handler, middles...)
+}
+
+// SetNotFound sets the handler called when no push route matches.
+func (p *ClientPool) SetNotFound(handler func(ctx *Context)) {
+	p.mux.SetNotFound(handler)
+}
@@ -0,0 +1,129 @@
+package spider
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/common"
+	"github.com/ywanbing/spider/message"
+)
+
+// newTestPoolServer 创建一个回复自己名字的服务端
+func newTestPoolServer(t *testing.T, name string) *testListener {
+	srv := NewTcpX()
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		_ = ctx.Raw(ctx.GetReqMsgId(), []byte(name))
+	})
+	return newTestListener(t, srv)
+}
+
+func testPoolCall(t *testing.T, c Caller, key string) string {
+	t.Helper()
+	req := message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 1))
+	if key != "" {
+		req.SetHeader("user", key)
+	}
+	resp, err := c.Call(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(resp.GetBody())
+}
+
+func TestClientPool(t *testing.T) {
+	a := newTestPoolServer(t, "a")
+	b := newTestPoolServer(t, "b")
+	addrs := []string{a.Addr().String(), b.Addr().String()}
+
+	t.Run("round robin", func(t *testing.T) {
+		pool := NewClientPool(addrs, WithPoolSize(2))
+		if err := pool.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer pool.Close()
+
+		counts := make(map[string]int)
+		for i := 0; i < 8; i++ {
+			counts[testPoolCall(t, pool, "")]++
+		}
+		if counts["a"] != 4 || counts["b"] != 4 {
+			t.Fatalf("calls should be balanced, got %v", counts)
+		}
+	})
+
+	t.Run("consistent hash", func(t *testing.T) {
+		pool := NewClientPool(addrs, WithPoolSize(2), WithBalancer(NewConsistentHashBalancer("user")))
+		if err := pool.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer pool.Close()
+
+		seen := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			key := strconv.Itoa(i)
+			name := testPoolCall(t, pool, key)
+			seen[name] = true
+			for j := 0; j < 3; j++ {
+				if got := testPoolCall(t, pool, key); got != name {
+					t.Fatalf("key %s should always go to %s, got %s", key, name, got)
+				}
+			}
+		}
+		if len(seen) != 2 {
+			t.Fatalf("keys should be spread over both addresses, got %v", seen)
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		pool := NewClientPool(addrs[:1], WithPoolConnOptions(WithReconnection(false)))
+		if err := pool.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer pool.Close()
+
+		a.dropAll()
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			req := message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 1))
+			if _, err := pool.Call(context.Background(), req); err == nil {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatalf("dead connection should be replaced, last error: %v", err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+
+	t.Run("no connection", func(t *testing.T) {
+		pool := NewClientPool(nil)
+		if err := pool.Start(); !errors.Is(err, code.ErrNoAvailableConn) {
+			t.Fatalf("want ErrNoAvailableConn, got %v", err)
+		}
+		call := pool.Go(context.Background(), message.NewMsgWithMsgID(1), nil)
+		if <-call.Done; !errors.Is(call.Error, code.ErrNoAvailableConn) {
+			t.Fatalf("want ErrNoAvailableConn, got %v", call.Error)
+		}
+	})
+}
+
+func TestLeastPendingBalancer(t *testing.T) {
+	clients := make([]*TcpClient, 3)
+	for i := range clients {
+		clients[i] = NewTcpClient(strconv.Itoa(i))
+		clients[i].pending = make(map[uint64]*Call)
+		for j := 0; j < 3-i%2*2; j++ {
+			clients[i].pending[uint64(j)] = nil
+		}
+	}
+
+	b := NewLeastPendingBalancer()
+	for i := 0; i < 3; i++ {
+		if got := b.Pick(clients, message.NewMsgWithMsgID(1)); got != clients[1] {
+			t.Fatalf("want the client with least pending calls, got %s", got.Addr())
+		}
+	}
+}
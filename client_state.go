@@ -0,0 +1,81 @@
+package spider
+
+import "context"
+
+// ConnState 客户端的连接状态
+type ConnState int32
+
+const (
+	// Idle 还没有建立连接，或者关闭自动重连后连接已经断开
+	Idle ConnState = iota
+	// Connecting 正在建立连接
+	Connecting
+	// Ready 连接可用
+	Ready
+	// TransientFailure 连接断开或者建立失败，等待重连
+	TransientFailure
+	// Shutdown 客户端已经关闭，不会再变化
+	Shutdown
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Idle:
+		return "IDLE"
+	case Connecting:
+		return "CONNECTING"
+	case Ready:
+		return "READY"
+	case TransientFailure:
+		return "TRANSIENT_FAILURE"
+	case Shutdown:
+		return "SHUTDOWN"
+	default:
+		return "INVALID_STATE"
+	}
+}
+
+// State 返回客户端当前的连接状态
+func (t *TcpClient) State() ConnState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.state
+}
+
+// WaitForStateChange 等待连接状态不再是 from，状态已经改变时返回 true，ctx 结束时返回 false。
+func (t *TcpClient) WaitForStateChange(ctx context.Context, from ConnState) bool {
+	for {
+		t.mutex.Lock()
+		state, changed := t.state, t.stateChanged
+		t.mutex.Unlock()
+		if state != from {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// setState 修改连接状态，客户端已经关闭时返回 false
+func (t *TcpClient) setState(state ConnState) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.setStateLocked(state)
+}
+
+// setStateLocked 和 setState 相同，调用时需要持有 t.mutex
+func (t *TcpClient) setStateLocked(state ConnState) bool {
+	if t.state == Shutdown {
+		return false
+	}
+	if t.state != state {
+		t.state = state
+		close(t.stateChanged)
+		t.stateChanged = make(chan struct{})
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package code
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Code 错误码，可以跨连接传递。
+// 框架使用 1000 以内的错误码，业务自定义的错误码建议从 1000 开始。
+type Code uint32
+
+const (
+	OK                Code = 0
+	Unknown           Code = 1
+	Canceled          Code = 2
+	InvalidArgument   Code = 3
+	DeadlineExceeded  Code = 4
+	NotFound          Code = 5
+	AlreadyExists     Code = 6
+	PermissionDenied  Code = 7
+	ResourceExhausted Code = 8
+	Unimplemented     Code = 9
+	Internal          Code = 10
+	Unavailable       Code = 11
+	Unauthenticated   Code = 12
+)
+
+var codeNames = map[Code]string{
+	OK:                "OK",
+	Unknown:           "Unknown",
+	Canceled:          "Canceled",
+	InvalidArgument:   "InvalidArgument",
+	DeadlineExceeded:  "DeadlineExceeded",
+	NotFound:          "NotFound",
+	AlreadyExists:     "AlreadyExists",
+	PermissionDenied:  "PermissionDenied",
+	ResourceExhausted: "ResourceExhausted",
+	Unimplemented:     "Unimplemented",
+	Internal:          "Internal",
+	Unavailable:       "Unavailable",
+	Unauthenticated:   "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Error 错误码本身可以作为哨兵错误，例如 errors.Is(err, code.NotFound)
+func (c Code) Error() string {
+	return c.String()
+}
+
+// Error 带有错误码的错误，错误码、错误信息和详情通过保留的消息头传递给对端。
+type Error struct {
+	Code    Code
+	Message string
+	// Details 错误的详细信息，可以为空
+	Details map[string]string
+}
+
+// NewError 创建一个带有错误码的错误
+func NewError(c Code, msg string) *Error {
+	return &Error{Code: c, Message: msg}
+}
+
+// Errorf 创建一个带有错误码的错误，错误信息使用 fmt.Sprintf 格式化
+func Errorf(c Code, format string, args ...any) *Error {
+	return NewError(c, fmt.Sprintf(format, args...))
+}
+
+// WithDetails 返回附带详情的错误副本
+func (e *Error) WithDetails(details map[string]string) *Error {
+	ne := *e
+	ne.Details = make(map[string]string, len(e.Details)+len(details))
+	for k, v := range e.Details {
+		ne.Details[k] = v
+	}
+	for k, v := range details {
+		ne.Details[k] = v
+	}
+	return &ne
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is 错误码相同时视为同一个错误，target 可以是 Code 或者 *Error
+func (e *Error) Is(target error) bool {
+	switch t := target.(type) {
+	case Code:
+		return e.Code == t
+	case *Error:
+		return e.Code == t.Code
+	default:
+		return false
+	}
+}
+
+// CodeOf 返回错误的错误码，nil 返回 OK，没有错误码的错误返回 Unknown
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	var c Code
+	if errors.As(err, &c) {
+		return c
+	}
+	return Unknown
+}
@@ -5,14 +5,29 @@ import "errors"
 // 统一错误信息
 
 var (
-	ErrNilMessage     = Error("message is nil")
-	ErrNilMetadata    = Error("metadata is nil")
-	ErrNilMsgType     = Error("msg type is empty")
-	ErrNilMsgSeq      = Error("msg seq is empty")
-	ErrConnClosed     = Error("connection is closed")
-	ErrMessageNotSent = Error("message not sent")
+	ErrNilMessage      = New("message is nil")
+	ErrNilMetadata     = New("metadata is nil")
+	ErrNilMsgType      = New("msg type is empty")
+	ErrNilMsgSeq       = New("msg seq is empty")
+	ErrConnClosed      = New("connection is closed")
+	ErrMessageNotSent  = New("message not sent")
+	ErrSendQueueFull   = New("send chan is full")
+	ErrSlowConsumer    = New("send chan stays full, connection closed")
+	ErrRecvQueueFull   = New("recv chan is full, connection closed")
+	ErrNoAvailableConn = New("no available connection")
+
+	ErrDeadlineExceeded = NewError(DeadlineExceeded, "request deadline exceeded")
+	ErrNotStream        = NewError(InvalidArgument, "not a stream")
+
+	ErrStreamClosed      = New("stream is closed")
+	ErrStreamCanceled    = New("stream is canceled")
+	ErrStreamNotFound    = New("stream route not found")
+	ErrStreamDuplicate   = New("stream id is already in use")
+	ErrStreamAborted     = New("stream handler is aborted")
+	ErrStreamFlowControl = New("stream flow control violated")
 )
 
-func Error(s string) error {
+// New 创建一个只有错误信息的错误，用于本地的错误判断
+func New(s string) error {
 	return errors.New(s)
 }
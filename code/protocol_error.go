@@ -0,0 +1,53 @@
+package code
+
+import "fmt"
+
+// 协议错误的原因，同时作为监控指标的标签
+const (
+	ReasonFrameTooLarge = "frame_too_large"
+	ReasonFrameTooSmall = "frame_too_small"
+	ReasonMalformed     = "malformed_frame"
+	ReasonDecrypt       = "decrypt_failed"
+	ReasonReplay        = "replayed_frame"
+	ReasonChecksum      = "checksum_mismatch"
+	ReasonFragment      = "invalid_fragment"
+)
+
+var (
+	ErrFrameTooLarge  = New("frame is too large")
+	ErrFrameTooSmall  = New("frame is too small")
+	ErrMalformedFrame = New("malformed frame")
+
+	ErrPrefaceMagic     = New("invalid preface magic")
+	ErrVersionMismatch  = New("protocol version mismatch")
+	ErrNoCommonCodec    = New("no common codec")
+	ErrCipherMismatch   = New("cipher suite mismatch")
+	ErrKeyExchange      = New("key exchange failed")
+	ErrNotHandshaken    = New("handshake is required")
+	ErrDecryptFailed    = New("decrypt failed")
+	ErrReplayedFrame    = New("replayed frame")
+	ErrChecksumMismatch = New("checksum mismatch")
+	ErrInvalidFragment  = New("invalid fragment")
+	ErrMessageTooLarge  = New("message is too large")
+	ErrReassemblyMemory = New("reassembly memory limit exceeded")
+)
+
+// ProtocolError 对端发送了不符合协议的数据，连接会被关闭。
+type ProtocolError struct {
+	// Reason 错误原因，例如 ReasonFrameTooLarge
+	Reason string
+	Err    error
+}
+
+// NewProtocolError 创建一个协议错误
+func NewProtocolError(reason string, err error) *ProtocolError {
+	return &ProtocolError{Reason: reason, Err: err}
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error [%s]: %v", e.Reason, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
@@ -1,6 +1,9 @@
 package codec
 
-import "errors"
+import (
+	"errors"
+	"sort"
+)
 
 type MarshalType byte
 
@@ -31,3 +34,15 @@ func GetMarshallerByMarshalType(marshalType MarshalType) Marshaller {
 	}
 	return m
 }
+
+// MarshalTypes 返回所有已注册的序列化类型
+func MarshalTypes() []MarshalType {
+	res := make([]MarshalType, 0, len(marshallerManager))
+	for t := range marshallerManager {
+		res = append(res, t)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
@@ -1,5 +1,7 @@
 package codec
 
+import "errors"
+
 const (
 	MarshalType_Raw MarshalType = 'R'
 )
@@ -9,8 +11,14 @@ type RawMarshaller struct{}
 func (rw RawMarshaller) Marshal(v any) ([]byte, error) {
 	return v.([]byte), nil
 }
+
+// Unmarshal dest should be *[]byte
 func (rw RawMarshaller) Unmarshal(data []byte, dest any) error {
-	dest = data
+	dst, ok := dest.(*[]byte)
+	if !ok {
+		return errors.New("raw marshaller requires dest to be *[]byte")
+	}
+	*dst = data
 	return nil
 }
 
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return new(Frame)
+	},
+}
+
+// Frame 带引用计数的发送帧。
+// 同一个帧可以被多个连接共享（例如广播），最后一次 Release 后数据才会归还到 LimitedPool。
+type Frame struct {
+	buf  []byte
+	pool *LimitedPool
+	refs atomic.Int32
+	// 发送优先级，数值越大越优先发送
+	priority int8
+	// 是否为分片消息的分片，分片不能被单独丢弃
+	fragment bool
+	// 写入后关闭连接，例如协议错误帧
+	final bool
+}
+
+// NewFrame 使用 buf 创建一个引用计数为 1 的帧。
+// pool 为 buf 的来源，为 nil 时释放后交由 GC 回收。
+func NewFrame(buf []byte, pool *LimitedPool) *Frame {
+	f := framePool.Get().(*Frame)
+	f.buf = buf
+	f.pool = pool
+	f.refs.Store(1)
+	f.priority = 0
+	f.fragment = false
+	f.final = false
+	return f
+}
+
+// Priority 返回帧的发送优先级
+func (f *Frame) Priority() int8 {
+	return f.priority
+}
+
+// SetPriority 设置帧的发送优先级，数值越大越优先发送
+func (f *Frame) SetPriority(p int8) {
+	f.priority = p
+}
+
+// Fragment 返回帧是否为分片消息的分片
+func (f *Frame) Fragment() bool {
+	return f.fragment
+}
+
+// SetFragment 标记帧为分片消息的分片
+func (f *Frame) SetFragment(fragment bool) {
+	f.fragment = fragment
+}
+
+// Final 返回写入后是否需要关闭连接
+func (f *Frame) Final() bool {
+	return f.final
+}
+
+// SetFinal 标记帧写入后关闭连接
+func (f *Frame) SetFinal(final bool) {
+	f.final = final
+}
+
+// Bytes 返回帧的数据，Release 之后不能再使用。
+func (f *Frame) Bytes() []byte {
+	return f.buf
+}
+
+// Len 返回帧的长度
+func (f *Frame) Len() int {
+	return len(f.buf)
+}
+
+// Retain 增加一次引用
+func (f *Frame) Retain() *Frame {
+	f.refs.Add(1)
+	return f
+}
+
+// Release 减少一次引用，引用为 0 时回收数据。
+func (f *Frame) Release() {
+	refs := f.refs.Add(-1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		panic("frame released too many times")
+	}
+
+	if f.pool != nil {
+		f.pool.Put(f.buf)
+	}
+	f.buf = nil
+	f.pool = nil
+	framePool.Put(f)
+}
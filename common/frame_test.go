@@ -0,0 +1,40 @@
+package common
+
+import "testing"
+
+func TestFrame_Release(t *testing.T) {
+	pool := NewLimitedPool(512, 4096)
+	buf := pool.Get(1000)
+
+	f := NewFrame(buf, pool)
+	f.Retain()
+	f.Retain()
+
+	f.Release()
+	f.Release()
+	if f.Bytes() == nil {
+		t.Fatal("frame released before the last reference")
+	}
+
+	f.Release()
+	if f.Bytes() != nil {
+		t.Fatal("frame should be released after the last reference")
+	}
+}
+
+func TestFrame_Reuse(t *testing.T) {
+	f := NewFrame(make([]byte, 8), nil)
+	f.SetPriority(1)
+	f.SetFragment(true)
+	f.SetFinal(true)
+	f.Release()
+
+	// 从缓存池中复用的帧不能保留之前的标记
+	for i := 0; i < 10; i++ {
+		f = NewFrame(make([]byte, 8), nil)
+		if f.Priority() != 0 || f.Fragment() || f.Final() {
+			t.Fatal("reused frame should be reset")
+		}
+		f.Release()
+	}
+}
@@ -3,6 +3,7 @@ package spider
 import (
 	"context"
 
+	"github.com/ywanbing/spider/code"
 	"github.com/ywanbing/spider/codec"
 	"github.com/ywanbing/spider/message"
 )
@@ -18,6 +19,8 @@ type Context struct {
 	// 当前的连接对象
 	conn TcpConn
 	t    *TcpServer
+	// 流处理函数使用的流
+	stream *Stream
 
 	// used to control middleware abort or next
 	// offset == ABORT, abort
@@ -98,6 +101,20 @@ func (c *Context) commonReplyWithMarshaller(marshaller codec.Marshaller, msgId u
 	return c.conn.SendMsg(message.NewMessage(msgId, marshaller.MarshalType(), md, bytes))
 }
 
+// Error 使用错误码回复错误，客户端的 Call 返回对应的 *code.Error
+func (c *Context) Error(errCode code.Code, msg string) error {
+	return c.ReplyError(code.NewError(errCode, msg))
+}
+
+// ReplyError 回复错误，*code.Error 的错误码和详情会一起发送给客户端
+func (c *Context) ReplyError(err error) error {
+	md := c.reqMsg.GetHeader()
+	md[message.MsgTypeKey] = message.MsgTypeReply.String()
+	m := message.NewMessage(c.reqMsg.GetMsgId(), c.reqMsg.GetMarshalType(), md, nil)
+	message.SetError(m, err)
+	return c.conn.SendMsg(m)
+}
+
 // Bind 自动反序列化
 func (c *Context) Bind(dest any) error {
 	return codec.GetMarshallerByMarshalType(c.reqMsg.GetMarshalType()).Unmarshal(c.reqMsg.GetBody(), dest)
@@ -132,3 +149,8 @@ func (c *Context) GetReqMsgId() uint32 {
 func (c *Context) GetReqMsg() message.Message {
 	return c.reqMsg
 }
+
+// Stream 获取流处理函数的流，不是流消息时返回 nil
+func (c *Context) Stream() *Stream {
+	return c.stream
+}
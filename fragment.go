@@ -0,0 +1,201 @@
+package spider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+)
+
+// fragmentHeader 分片信息，保存在消息头 message.MsgFragment 中。
+// 第一个分片带有原消息的全部消息头，后续的分片只带有分片信息。
+type fragmentHeader struct {
+	// 同一个连接中分片消息的唯一 id
+	id uint64
+	// 分片的序号，从 0 开始
+	index int
+	// 分片的数量
+	count int
+	// 原消息体的长度
+	size int
+}
+
+func (h fragmentHeader) String() string {
+	return fmt.Sprintf("%d:%d:%d:%d", h.id, h.index, h.count, h.size)
+}
+
+func parseFragmentHeader(s string) (fragmentHeader, error) {
+	var (
+		h   fragmentHeader
+		err error
+	)
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 {
+		return h, fmt.Errorf("%w: %q", code.ErrInvalidFragment, s)
+	}
+	if h.id, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return h, fmt.Errorf("%w: %q", code.ErrInvalidFragment, s)
+	}
+	for i, v := range []*int{&h.index, &h.count, &h.size} {
+		if *v, err = strconv.Atoi(parts[i+1]); err != nil || *v < 0 {
+			return h, fmt.Errorf("%w: %q", code.ErrInvalidFragment, s)
+		}
+	}
+	if h.index >= h.count {
+		return h, fmt.Errorf("%w: %q", code.ErrInvalidFragment, s)
+	}
+	return h, nil
+}
+
+// splitMessage 将消息体按照 chunkSize 拆分为分片，依次调用 fn。
+// 分片的消息体引用原消息体，不会拷贝。
+func splitMessage(m message.Message, id uint64, chunkSize int, fn func(message.Message) error) error {
+	body := m.GetBody()
+	h := fragmentHeader{
+		id:    id,
+		count: (len(body) + chunkSize - 1) / chunkSize,
+		size:  len(body),
+	}
+	for ; h.index < h.count; h.index++ {
+		end := (h.index + 1) * chunkSize
+		if end > len(body) {
+			end = len(body)
+		}
+
+		var header map[string]string
+		if h.index == 0 {
+			header = make(map[string]string, len(m.GetHeader())+1)
+			for k, v := range m.GetHeader() {
+				header[k] = v
+			}
+		} else {
+			header = make(map[string]string, 2)
+			if p, ok := m.GetHeader()[message.MsgPriority]; ok {
+				header[message.MsgPriority] = p
+			}
+		}
+		header[message.MsgFragment] = h.String()
+
+		f := message.NewMessage(m.GetMsgId(), m.GetMarshalType(), header, body[h.index*chunkSize:end])
+		f.SetFlags(m.GetFlags())
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partialMessage 正在重组的消息
+type partialMessage struct {
+	// 第一个分片，重组后使用它的消息头
+	first  message.Message
+	header fragmentHeader
+	body   []byte
+	// 下一个分片的序号
+	next     int
+	deadline time.Time
+}
+
+// reassembler 重组分片消息，只在连接的处理协程中使用。
+type reassembler struct {
+	// 单个消息的最大长度
+	maxSize int
+	// 所有未完成消息占用的最大内存
+	maxMemory int
+	// 从收到第一个分片开始，重组的超时时间
+	timeout time.Duration
+
+	memory  int
+	pending map[uint64]*partialMessage
+}
+
+func newReassembler(maxSize, maxMemory int, timeout time.Duration) *reassembler {
+	return &reassembler{
+		maxSize:   maxSize,
+		maxMemory: maxMemory,
+		timeout:   timeout,
+		pending:   make(map[uint64]*partialMessage),
+	}
+}
+
+// add 添加一个分片，消息重组完成时返回完整的消息，否则返回 nil。
+// 分片不合法或者超过内存限制时返回 code.ProtocolError。
+func (r *reassembler) add(m message.Message, now time.Time) (message.Message, error) {
+	h, err := parseFragmentHeader(m.GetHeader()[message.MsgFragment])
+	if err != nil {
+		return nil, code.NewProtocolError(code.ReasonFragment, err)
+	}
+
+	p, ok := r.pending[h.id]
+	if h.index == 0 {
+		if ok {
+			return nil, code.NewProtocolError(code.ReasonFragment,
+				fmt.Errorf("%w: duplicate fragment id %d", code.ErrInvalidFragment, h.id))
+		}
+		if h.size > r.maxSize {
+			return nil, code.NewProtocolError(code.ReasonFragment,
+				fmt.Errorf("%w: %d > %d", code.ErrMessageTooLarge, h.size, r.maxSize))
+		}
+		if r.memory+h.size > r.maxMemory {
+			return nil, code.NewProtocolError(code.ReasonFragment,
+				fmt.Errorf("%w: %d + %d > %d", code.ErrReassemblyMemory, r.memory, h.size, r.maxMemory))
+		}
+
+		// 不按照对端声明的长度预先分配，随着分片到达增长
+		p = &partialMessage{
+			first:    m,
+			header:   h,
+			body:     make([]byte, 0, len(m.GetBody())),
+			deadline: now.Add(r.timeout),
+		}
+		r.pending[h.id] = p
+		r.memory += h.size
+	} else if !ok {
+		// 已经超时被丢弃
+		return nil, nil
+	}
+
+	if h.index != p.next || h.count != p.header.count || h.size != p.header.size ||
+		len(p.body)+len(m.GetBody()) > h.size {
+		r.remove(h.id)
+		return nil, code.NewProtocolError(code.ReasonFragment,
+			fmt.Errorf("%w: unexpected fragment %s", code.ErrInvalidFragment, h))
+	}
+	p.body = append(p.body, m.GetBody()...)
+	p.next++
+	if p.next < h.count {
+		return nil, nil
+	}
+
+	r.remove(h.id)
+	if len(p.body) != h.size {
+		return nil, code.NewProtocolError(code.ReasonFragment,
+			fmt.Errorf("%w: body size %d != %d", code.ErrInvalidFragment, len(p.body), h.size))
+	}
+
+	header := p.first.GetHeader()
+	delete(header, message.MsgFragment)
+	msg := message.NewMessage(p.first.GetMsgId(), p.first.GetMarshalType(), header, p.body)
+	msg.SetFlags(p.first.GetFlags())
+	return msg, nil
+}
+
+// expire 丢弃超时的消息
+func (r *reassembler) expire(now time.Time) {
+	for id, p := range r.pending {
+		if now.After(p.deadline) {
+			// TODO log 分片消息重组超时
+			r.remove(id)
+		}
+	}
+}
+
+func (r *reassembler) remove(id uint64) {
+	if p, ok := r.pending[id]; ok {
+		r.memory -= p.header.size
+		delete(r.pending, id)
+	}
+}
@@ -0,0 +1,79 @@
+package spider
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+)
+
+// splitTestMessage 将长度为 size 的消息体按照 10 字节拆分
+func splitTestMessage(t *testing.T, id uint64, size int) []message.Message {
+	t.Helper()
+	m := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypePush.String(),
+	}, make([]byte, size))
+
+	var fragments []message.Message
+	err := splitMessage(m, id, 10, func(m message.Message) error {
+		fragments = append(fragments, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fragments
+}
+
+func TestReassembler(t *testing.T) {
+	now := time.Now()
+
+	t.Run("limits", func(t *testing.T) {
+		r := newReassembler(100, 150, time.Second)
+		if _, err := r.add(splitTestMessage(t, 1, 101)[0], now); !errors.Is(err, code.ErrMessageTooLarge) {
+			t.Fatalf("max size: got %v", err)
+		}
+		if _, err := r.add(splitTestMessage(t, 2, 100)[0], now); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.add(splitTestMessage(t, 3, 100)[0], now); !errors.Is(err, code.ErrReassemblyMemory) {
+			t.Fatalf("max memory: got %v", err)
+		}
+
+		// 超时后释放内存，后续的分片被忽略
+		r.expire(now.Add(2 * time.Second))
+		if r.memory != 0 {
+			t.Fatalf("memory: want 0, got %d", r.memory)
+		}
+		if m, err := r.add(splitTestMessage(t, 2, 100)[1], now); m != nil || err != nil {
+			t.Fatalf("expired: got %v, %v", m, err)
+		}
+	})
+
+	t.Run("out-of-order", func(t *testing.T) {
+		r := newReassembler(100, 150, time.Second)
+		fragments := splitTestMessage(t, 1, 30)
+		_, _ = r.add(fragments[0], now)
+		var pe *code.ProtocolError
+		if _, err := r.add(fragments[2], now); !errors.As(err, &pe) || pe.Reason != code.ReasonFragment {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("grow", func(t *testing.T) {
+		// 不按照第一个分片声明的长度分配内存
+		r := newReassembler(100, 150, time.Second)
+		fragments := splitTestMessage(t, 1, 100)
+		_, _ = r.add(fragments[0], now)
+		if size := cap(r.pending[1].body); size > 10 {
+			t.Fatalf("capacity: want <= 10, got %d", size)
+		}
+		for _, f := range fragments[1:] {
+			if _, err := r.add(f, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package spider
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// inflightSet 连接上正在处理的请求，按照 message.MsgSeq 取消对应的处理函数
+type inflightSet struct {
+	mu       sync.Mutex
+	requests map[string]*inflightRequest
+	// 连接关闭后不再记录，新的请求直接取消
+	closed bool
+}
+
+type inflightRequest struct {
+	cancel context.CancelFunc
+}
+
+// add 记录请求，返回处理函数使用的上下文和处理完成后调用的函数。
+// deadline 不为零值时，上下文在 deadline 之后结束。
+func (s *inflightSet) add(seq string, deadline time.Time) (context.Context, func()) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		cancel()
+		return ctx, cancel
+	}
+	if _, ok := s.requests[seq]; ok || seq == "" {
+		// 没有序号或者序号重复的请求无法被取消
+		return ctx, cancel
+	}
+	if s.requests == nil {
+		s.requests = make(map[string]*inflightRequest)
+	}
+	r := &inflightRequest{cancel: cancel}
+	s.requests[seq] = r
+
+	return ctx, func() {
+		s.mu.Lock()
+		if s.requests[seq] == r {
+			delete(s.requests, seq)
+		}
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel 取消 seq 对应的请求，请求已经处理完成时忽略
+func (s *inflightSet) cancel(seq string) {
+	s.mu.Lock()
+	r := s.requests[seq]
+	delete(s.requests, seq)
+	s.mu.Unlock()
+
+	if r != nil {
+		r.cancel()
+	}
+}
+
+// closeAll 连接关闭后取消所有的请求
+func (s *inflightSet) closeAll() {
+	s.mu.Lock()
+	s.closed = true
+	requests := s.requests
+	s.requests = nil
+	s.mu.Unlock()
+
+	for _, r := range requests {
+		r.cancel()
+	}
+}
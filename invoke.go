@@ -0,0 +1,96 @@
+package spider
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/ywanbing/spider/codec"
+	"github.com/ywanbing/spider/message"
+	"google.golang.org/protobuf/proto"
+)
+
+// Caller 发送请求并等待响应，例如 TcpClient
+type Caller interface {
+	Call(c context.Context, req message.Message) (message.Message, error)
+}
+
+// InvokeOption 单次调用的选项
+type InvokeOption func(*invokeOptions)
+
+type invokeOptions struct {
+	// 为 nil 时根据请求的类型选择
+	marshaller codec.Marshaller
+	metadata   map[string]string
+}
+
+// WithCallMarshaller sets the marshaller of the request body.
+// default: protobuf for proto.Message, raw for []byte, json otherwise.
+func WithCallMarshaller(m codec.Marshaller) InvokeOption {
+	return func(o *invokeOptions) {
+		o.marshaller = m
+	}
+}
+
+// WithCallMetadata adds headers to the request.
+func WithCallMetadata(md map[string]string) InvokeOption {
+	return func(o *invokeOptions) {
+		if o.metadata == nil {
+			o.metadata = make(map[string]string, len(md))
+		}
+		for k, v := range md {
+			o.metadata[k] = v
+		}
+	}
+}
+
+// Invoke 序列化 req 后发送请求，并按照响应的序列化类型反序列化为 Resp。
+// 服务端回复的错误通过 error 返回，带有错误码的错误为 *code.Error。
+func Invoke[Req, Resp any](ctx context.Context, c Caller, msgId uint32, req Req, opts ...InvokeOption) (Resp, error) {
+	var resp Resp
+
+	o := invokeOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.marshaller == nil {
+		o.marshaller = marshallerOf(req)
+	}
+
+	body, err := o.marshaller.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	md := make(map[string]string, len(o.metadata)+2)
+	for k, v := range o.metadata {
+		md[k] = v
+	}
+
+	respMsg, err := c.Call(ctx, message.NewMessage(msgId, o.marshaller.MarshalType(), md, body))
+	if err != nil {
+		return resp, err
+	}
+
+	// 指针类型需要先分配
+	dest := any(&resp)
+	if t := reflect.TypeOf(resp); t != nil && t.Kind() == reflect.Pointer {
+		resp = reflect.New(t.Elem()).Interface().(Resp)
+		dest = resp
+	}
+	if len(respMsg.GetBody()) == 0 {
+		return resp, nil
+	}
+	err = codec.GetMarshallerByMarshalType(respMsg.GetMarshalType()).Unmarshal(respMsg.GetBody(), dest)
+	return resp, err
+}
+
+// marshallerOf 根据类型选择序列化方式
+func marshallerOf(v any) codec.Marshaller {
+	switch v.(type) {
+	case proto.Message:
+		return codec.ProtobufMarshaller{}
+	case []byte:
+		return codec.RawMarshaller{}
+	default:
+		return codec.JsonMarshaller{}
+	}
+}
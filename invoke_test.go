@@ -0,0 +1,65 @@
+package spider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/common"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testGreet struct {
+	Name string `json:"name"`
+}
+
+func TestInvoke(t *testing.T) {
+	jsonId := common.NewMsgIdWithSubMsgID(1, 1)
+	protoId := common.NewMsgIdWithSubMsgID(1, 2)
+	rawId := common.NewMsgIdWithSubMsgID(1, 3)
+
+	srv := NewTcpX()
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		var req testGreet
+		if err := ctx.Bind(&req); err != nil || req.Name == "" {
+			_ = ctx.Error(code.InvalidArgument, "name is required")
+			return
+		}
+		_ = ctx.JSON(jsonId, testGreet{Name: "hello " + req.Name + " " + ctx.GetReqMsg().GetHeader()["lang"]})
+	})
+	srv.RegisterHandler(1, 2, func(ctx *Context) {
+		req := new(wrapperspb.StringValue)
+		if err := ctx.Bind(req); err != nil {
+			_ = ctx.ReplyError(err)
+			return
+		}
+		_ = ctx.ProtoBuf(protoId, wrapperspb.String("hello "+req.GetValue()))
+	})
+	srv.RegisterHandler(1, 3, func(ctx *Context) {
+		_ = ctx.Raw(rawId, append([]byte("hello "), ctx.RawData()...))
+	})
+	client := newTestClient(t, srv)
+	ctx := context.Background()
+
+	greet, err := Invoke[testGreet, testGreet](ctx, client, jsonId, testGreet{Name: "json"},
+		WithCallMetadata(map[string]string{"lang": "en"}))
+	if err != nil || greet.Name != "hello json en" {
+		t.Fatalf("json: got %v, %v", greet, err)
+	}
+
+	_, err = Invoke[testGreet, *testGreet](ctx, client, jsonId, testGreet{})
+	if !errors.Is(err, code.InvalidArgument) {
+		t.Fatalf("want InvalidArgument, got %v", err)
+	}
+
+	pb, err := Invoke[*wrapperspb.StringValue, *wrapperspb.StringValue](ctx, client, protoId, wrapperspb.String("proto"))
+	if err != nil || pb.GetValue() != "hello proto" {
+		t.Fatalf("protobuf: got %v, %v", pb, err)
+	}
+
+	raw, err := Invoke[[]byte, []byte](ctx, client, rawId, []byte("raw"))
+	if err != nil || string(raw) != "hello raw" {
+		t.Fatalf("raw: got %q, %v", raw, err)
+	}
+}
@@ -0,0 +1,57 @@
+package message
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/ywanbing/spider/code"
+)
+
+// SetError 将错误写入消息头。
+// 错误信息保存在 MsgErr 中，code.Error 的错误码和详情保存在保留的消息头中。
+func SetError(m Message, err error) {
+	if err == nil {
+		return
+	}
+	var e *code.Error
+	if !errors.As(err, &e) {
+		m.SetHeader(MsgErr, err.Error())
+		return
+	}
+
+	m.SetHeader(MsgErr, e.Message)
+	m.SetHeader(MsgErrCode, strconv.FormatUint(uint64(e.Code), 10))
+	for k, v := range e.Details {
+		m.SetHeader(MsgErrDetailPrefix+k, v)
+	}
+}
+
+// GetError 从消息头中还原错误，没有错误时返回 nil。
+// 带有错误码的错误还原为 *code.Error，否则只保留错误信息。
+func GetError(m Message) error {
+	header := m.GetHeader()
+	errStr := header[MsgErr]
+	codeStr, ok := header[MsgErrCode]
+	if !ok {
+		if errStr == "" {
+			return nil
+		}
+		return errors.New(errStr)
+	}
+
+	c := code.Unknown
+	if n, err := strconv.ParseUint(codeStr, 10, 32); err == nil {
+		c = code.Code(n)
+	}
+	e := code.NewError(c, errStr)
+	for k, v := range header {
+		if strings.HasPrefix(k, MsgErrDetailPrefix) {
+			if e.Details == nil {
+				e.Details = make(map[string]string)
+			}
+			e.Details[strings.TrimPrefix(k, MsgErrDetailPrefix)] = v
+		}
+	}
+	return e
+}
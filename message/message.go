@@ -22,6 +22,12 @@ type Message interface {
 	// SetBody 设置消息的内容
 	SetBody([]byte)
 
+	// GetFlags 获取帧标志位，由 Proto 使用，例如消息体是否被压缩
+	GetFlags() uint16
+
+	// SetFlags 设置帧标志位
+	SetFlags(uint16)
+
 	// Check 自我检查
 	Check() error
 }
@@ -34,16 +40,70 @@ const (
 	MsgTypeReply     MsgType = 2
 	MsgTypePush      MsgType = 3
 	MsgTypeHeartBeat MsgType = 4
+	// MsgTypeError 连接级别的错误，发送后连接会被关闭，错误信息在 MsgErr 中
+	MsgTypeError MsgType = 5
+	// MsgTypeStream 流消息，通过 MsgStreamId 区分不同的流
+	MsgTypeStream MsgType = 6
+	// MsgTypeCancel 取消请求，MsgSeq 为被取消的请求
+	MsgTypeCancel MsgType = 7
 )
 
 // 定义一些默认的消息头的Key
 const (
-	MsgTypeKey  = "msg_type"
-	MsgSeq      = "msg_seq"
-	MsgErr      = "msg_err"
-	OpenTracing = "open_trace"
+	MsgTypeKey = "msg_type"
+	MsgSeq     = "msg_seq"
+	MsgErr     = "msg_err"
+	// MsgErrCode code.Error 的错误码
+	MsgErrCode = "msg_err_code"
+	// MsgErrDetailPrefix code.Error 的详情，每一项保存在 MsgErrDetailPrefix + key 中
+	MsgErrDetailPrefix = "msg_err_detail."
+	OpenTracing        = "open_trace"
+	// MsgFragment 分片消息的分片信息，格式：id:index:count:size
+	MsgFragment = "msg_frag"
+	// MsgStreamId 流消息所属的流
+	MsgStreamId = "msg_stream"
+	// MsgStreamOp 流消息的操作类型，例如 data，end
+	MsgStreamOp = "msg_stream_op"
+	// MsgStreamCredit 流控额度，对端最多还可以发送的消息数量
+	MsgStreamCredit = "msg_stream_credit"
+	// MsgTimeout 请求剩余的处理时间，格式同 time.Duration，例如 200ms
+	MsgTimeout = "msg_timeout"
+	// MsgPriority 消息的发送优先级，例如 high，low
+	MsgPriority = "msg_priority"
+)
+
+// Priority 消息在发送队列中的优先级，数值越大越优先发送
+type Priority int8
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
 )
 
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// PriorityFromString 通过string 转换成 Priority，未知的值为 PriorityNormal
+func PriorityFromString(s string) Priority {
+	switch s {
+	case "low":
+		return PriorityLow
+	case "high":
+		return PriorityHigh
+	default:
+		return PriorityNormal
+	}
+}
+
 func (m MsgType) String() string {
 	switch m {
 	case MsgTypeRequest:
@@ -54,6 +114,12 @@ func (m MsgType) String() string {
 		return "push"
 	case MsgTypeHeartBeat:
 		return "heartbeat"
+	case MsgTypeError:
+		return "error"
+	case MsgTypeStream:
+		return "stream"
+	case MsgTypeCancel:
+		return "cancel"
 	default:
 		return "unknown"
 	}
@@ -70,6 +136,12 @@ func MsgTypeFromString(s string) MsgType {
 		return MsgTypePush
 	case "heartbeat":
 		return MsgTypeHeartBeat
+	case "error":
+		return MsgTypeError
+	case "stream":
+		return MsgTypeStream
+	case "cancel":
+		return MsgTypeCancel
 	default:
 		return MsgTypeUnknown
 	}
@@ -19,6 +19,9 @@ type RawMessage struct {
 
 	metadata map[string]string
 	body     []byte
+
+	// 帧标志位
+	flags uint16
 }
 
 var (
@@ -45,6 +48,14 @@ func (m *RawMessage) SetBody(body []byte) {
 	m.body = body
 }
 
+func (m *RawMessage) GetFlags() uint16 {
+	return m.flags
+}
+
+func (m *RawMessage) SetFlags(flags uint16) {
+	m.flags = flags
+}
+
 func (m *RawMessage) GetMsgId() uint32 {
 	if m == nil {
 		return 0
@@ -0,0 +1,48 @@
+package spider
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics 连接层面的监控指标，可以通过 WithMetrics 接入 prometheus 等监控系统。
+type Metrics interface {
+	// IncProtocolError 协议错误计数，reason 为 code.ProtocolError 的 Reason
+	IncProtocolError(reason string)
+}
+
+var defaultMetrics = NewCounterMetrics()
+
+// DefaultMetrics 返回默认使用的 CounterMetrics
+func DefaultMetrics() *CounterMetrics {
+	return defaultMetrics
+}
+
+// CounterMetrics 基于内存计数的 Metrics 实现
+type CounterMetrics struct {
+	protocolErrors sync.Map // map[string]*atomic.Uint64
+}
+
+var _ Metrics = new(CounterMetrics)
+
+func NewCounterMetrics() *CounterMetrics {
+	return &CounterMetrics{}
+}
+
+func (m *CounterMetrics) IncProtocolError(reason string) {
+	v, ok := m.protocolErrors.Load(reason)
+	if !ok {
+		v, _ = m.protocolErrors.LoadOrStore(reason, new(atomic.Uint64))
+	}
+	v.(*atomic.Uint64).Add(1)
+}
+
+// ProtocolErrors 返回每种原因的协议错误数量
+func (m *CounterMetrics) ProtocolErrors() map[string]uint64 {
+	res := make(map[string]uint64)
+	m.protocolErrors.Range(func(key, value any) bool {
+		res[key.(string)] = value.(*atomic.Uint64).Load()
+		return true
+	})
+	return res
+}
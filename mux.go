@@ -1,6 +1,11 @@
 package spider
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+)
 
 type (
 	modelID  = int32
@@ -20,6 +25,9 @@ type Mux struct {
 	// global-middles
 	// 全局中间件
 	GlobalMiddles []func(ctx *Context)
+
+	// 没有找到路由时的处理函数，可以为空
+	NotFound func(ctx *Context)
 }
 
 // MsgMiddleHandler 模块处理函数
@@ -31,6 +39,8 @@ type MsgMiddleHandler struct {
 	Handlers map[subMsgID]func(ctx *Context)
 	// 消息处理函数的中间件
 	HandlerMiddles map[subMsgID][]func(ctx *Context)
+	// 流处理函数对应的消息ID
+	Streams map[subMsgID]bool
 }
 
 // newMux returns a new Mux.
@@ -56,12 +66,8 @@ func (m *Mux) RegisterModelMiddle(id modelID, middles ...func(ctx *Context)) {
 		panic(errors.New("不允许添加中间件,需要在启动前添加"))
 	}
 
-	if m.Handlers[id] == nil {
-		m.Handlers[id] = &MsgMiddleHandler{
-			ModelMiddles: make([]func(ctx *Context), 0, 4),
-		}
-	}
-	m.Handlers[id].ModelMiddles = append(m.Handlers[id].ModelMiddles, middles...)
+	handler := m.handler(id)
+	handler.ModelMiddles = append(handler.ModelMiddles, middles...)
 }
 
 // RegisterHandler add routing handlers by modelID and subMsgID.
@@ -70,17 +76,53 @@ func (m *Mux) RegisterHandler(id modelID, subID subMsgID, handler func(ctx *Cont
 		panic(errors.New("不允许添加路由,需要在启动前添加"))
 	}
 
+	h := m.handler(id)
+	if h.Handlers[subID] != nil {
+		panic(errors.New("路由已存在"))
+	}
+
+	h.Handlers[subID] = handler
+	h.HandlerMiddles[subID] = append(h.HandlerMiddles[subID], middles...)
+}
+
+// SetNotFound sets the handler called when no route matches.
+func (m *Mux) SetNotFound(handler func(ctx *Context)) {
+	if !m.AllowAdd {
+		panic(errors.New("不允许添加路由,需要在启动前添加"))
+	}
+	m.NotFound = handler
+}
+
+// handler 返回模块的处理函数，不存在时创建
+func (m *Mux) handler(id modelID) *MsgMiddleHandler {
 	if m.Handlers[id] == nil {
 		m.Handlers[id] = &MsgMiddleHandler{
+			ModelMiddles:   make([]func(ctx *Context), 0, 4),
 			Handlers:       make(map[subMsgID]func(ctx *Context)),
 			HandlerMiddles: make(map[subMsgID][]func(ctx *Context)),
 		}
 	}
+	return m.Handlers[id]
+}
 
-	if m.Handlers[id].Handlers[subID] != nil {
-		panic(errors.New("路由已存在"))
-	}
+// RegisterStreamHandler add stream handlers by modelID and subMsgID.
+// The stream ends after the handler returns, and the returned error is sent to the client.
+func (m *Mux) RegisterStreamHandler(id modelID, subID subMsgID, handler StreamHandler, middles ...func(ctx *Context)) {
+	m.RegisterHandler(id, subID, func(ctx *Context) {
+		s := ctx.Stream()
+		if s == nil {
+			// 普通的消息不能调用流处理函数，请求回复错误
+			if message.MsgTypeFromString(ctx.GetReqMsg().GetHeader()[message.MsgTypeKey]) == message.MsgTypeRequest {
+				// TODO log 发送失败
+				_ = ctx.ReplyError(code.ErrNotStream)
+			}
+			return
+		}
+		s.finish(handler(ctx, s))
+	}, middles...)
 
-	m.Handlers[id].Handlers[subID] = handler
-	m.Handlers[id].HandlerMiddles[subID] = append(m.Handlers[id].HandlerMiddles[subID], middles...)
+	if m.Handlers[id].Streams == nil {
+		m.Handlers[id].Streams = make(map[subMsgID]bool)
+	}
+	m.Handlers[id].Streams[subID] = true
 }
@@ -0,0 +1,182 @@
+package proto
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/ywanbing/spider/message"
+)
+
+// BodyTransform 对消息体进行变换，例如压缩、加密、校验。
+// 通过 Chain 可以在任意 Proto 上按任意顺序组合多个变换。
+// header 为消息头部的编码，见 encodeTransformHeader，可以用于认证头部，不能修改。
+type BodyTransform interface {
+	// Encode 发送时变换消息体，返回新的消息体和帧标志位，不能修改 body
+	Encode(header, body []byte, flags uint16) ([]byte, uint16, error)
+	// Decode 接收时还原消息体，返回新的消息体和帧标志位
+	Decode(header, body []byte, flags uint16) ([]byte, uint16, error)
+}
+
+// LaneEncoder 可以由 BodyTransform 实现，变换的结果依赖发送顺序时（例如加密的计数器），
+// 按照 LanePacker 的 lane 分别处理。
+type LaneEncoder interface {
+	EncodeLane(header, body []byte, flags uint16, lane uint8) ([]byte, uint16, error)
+}
+
+// TransformHandshaker 可以由 BodyTransform 实现，在连接前导协商完成后调用，
+// 返回该连接专用的 BodyTransform，例如使用协商的压缩算法或者交换的密钥。
+type TransformHandshaker interface {
+	Handshake(rw io.ReadWriter, n Negotiated) (BodyTransform, error)
+}
+
+// ChainProto 在 base 的基础上依次执行多个 BodyTransform。
+// 发送时按顺序执行 Encode，接收时按相反的顺序执行 Decode。
+type ChainProto struct {
+	base       Proto
+	transforms []BodyTransform
+}
+
+var (
+	_ PoolPacker   = new(ChainProto)
+	_ LanePacker   = new(ChainProto)
+	_ Handshaker   = new(ChainProto)
+	_ Compressible = new(ChainProto)
+)
+
+// Chain 创建一个 ChainProto，例如：
+//
+//	Chain(NewRawProto(), NewCompressTransform(ZstdCompressorName, 0), NewEncryptTransform(CipherAES256GCM), NewChecksumTransform())
+//
+// 表示先压缩，再加密，最后计算校验和。
+func Chain(base Proto, transforms ...BodyTransform) *ChainProto {
+	return &ChainProto{
+		base:       base,
+		transforms: transforms,
+	}
+}
+
+func (c *ChainProto) Pack(m message.Message) ([]byte, error) {
+	return c.PackWith(m, nil)
+}
+
+// PackWith 依次变换消息体后，使用 base 打包，不修改原消息
+func (c *ChainProto) PackWith(m message.Message, alloc func(size int) []byte) ([]byte, error) {
+	return c.PackLaneWith(m, 0, alloc)
+}
+
+// PackLaneWith 和 PackWith 相同，实现了 LaneEncoder 的变换和 base 按照 lane 处理
+func (c *ChainProto) PackLaneWith(m message.Message, lane uint8, alloc func(size int) []byte) ([]byte, error) {
+	if len(c.transforms) > 0 {
+		header := encodeTransformHeader(m)
+		body, flags := m.GetBody(), m.GetFlags()
+		for _, t := range c.transforms {
+			var err error
+			if le, ok := t.(LaneEncoder); ok {
+				body, flags, err = le.EncodeLane(header, body, flags, lane)
+			} else {
+				body, flags, err = t.Encode(header, body, flags)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		tm := message.NewMessage(m.GetMsgId(), m.GetMarshalType(), m.GetHeader(), body)
+		tm.SetFlags(flags)
+		m = tm
+	}
+
+	return packLane(c.base, m, lane, alloc)
+}
+
+// Unpack 使用 base 解析后，按相反的顺序还原消息体
+func (c *ChainProto) Unpack(data []byte) (message.Message, error) {
+	m, err := c.base.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.transforms) == 0 {
+		return m, nil
+	}
+
+	header := encodeTransformHeader(m)
+	body, flags := m.GetBody(), m.GetFlags()
+	for i := len(c.transforms) - 1; i >= 0; i-- {
+		if body, flags, err = c.transforms[i].Decode(header, body, flags); err != nil {
+			return nil, err
+		}
+	}
+	m.SetBody(body)
+	m.SetFlags(flags)
+	return m, nil
+}
+
+// Handshake 返回该连接专用的 ChainProto，没有需要协商的变换时返回自身
+func (c *ChainProto) Handshake(rw io.ReadWriter, n Negotiated) (Proto, error) {
+	changed := false
+	base := c.base
+	if h, ok := base.(Handshaker); ok {
+		var err error
+		if base, err = h.Handshake(rw, n); err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+
+	transforms := make([]BodyTransform, len(c.transforms))
+	for i, t := range c.transforms {
+		transforms[i] = t
+		if h, ok := t.(TransformHandshaker); ok {
+			var err error
+			if transforms[i], err = h.Handshake(rw, n); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+	}
+
+	if !changed {
+		return c, nil
+	}
+	return Chain(base, transforms...), nil
+}
+
+// Compressions 返回变换或者 base 支持的压缩算法
+func (c *ChainProto) Compressions() []string {
+	for _, t := range c.transforms {
+		if cp, ok := t.(Compressible); ok {
+			return cp.Compressions()
+		}
+	}
+	if cp, ok := c.base.(Compressible); ok {
+		return cp.Compressions()
+	}
+	return nil
+}
+
+// encodeTransformHeader 编码传递给 BodyTransform 的消息头部，不依赖 base 的编码方式，
+// 元数据按照 key 排序，双方得到相同的结果。
+// 格式：[msgId = 4][marshalType = 1]([keyLen = uvarint][key][valueLen = uvarint][value])...
+func encodeTransformHeader(m message.Message) []byte {
+	md := m.GetHeader()
+	keys := make([]string, 0, len(md))
+	size := MsgIDSize + ProtoSize
+	for k, v := range md {
+		keys = append(keys, k)
+		size += uvarintSize(len(k)) + len(k) + uvarintSize(len(v)) + len(v)
+	}
+	sort.Strings(keys)
+
+	data := make([]byte, MsgIDSize+ProtoSize, size)
+	binary.BigEndian.PutUint32(data, m.GetMsgId())
+	data[MsgIDSize] = byte(m.GetMarshalType())
+	for _, k := range keys {
+		data = binary.AppendUvarint(data, uint64(len(k)))
+		data = append(data, k...)
+		data = binary.AppendUvarint(data, uint64(len(md[k])))
+		data = append(data, md[k]...)
+	}
+	return data
+}
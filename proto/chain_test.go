@@ -0,0 +1,67 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+)
+
+func TestChain(t *testing.T) {
+	newChain := func() *ChainProto {
+		return Chain(NewBinaryHeaderProto(),
+			NewCompressTransform(ZstdCompressorName, 0),
+			NewEncryptTransform(CipherChaCha20Poly1305),
+			NewChecksumTransform(),
+		)
+	}
+	pa, pb, err := handshakePair(t, newChain(), newChain())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("spider"), 1024)
+	m := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypePush.String(),
+	}, body)
+
+	data, err := pa.Pack(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(body) {
+		t.Fatalf("body should be compressed, frame size %d", len(data))
+	}
+	if !bytes.Equal(m.GetBody(), body) || m.GetFlags() != 0 {
+		t.Fatal("Pack should not modify the message")
+	}
+
+	got, err := pb.Unpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.GetBody(), body) || got.GetFlags()&^FlagBinaryHeader != 0 {
+		t.Fatalf("unpack: body mismatch, flags %b", got.GetFlags())
+	}
+
+	// 最后一个变换最先校验
+	data, _ = pa.Pack(m)
+	data[len(data)-1] ^= 0xff
+	if _, err = pb.Unpack(data); !errors.Is(err, code.ErrChecksumMismatch) {
+		t.Fatalf("corrupt: got %v", err)
+	}
+}
+
+func TestChain_HandshakeWithoutTransforms(t *testing.T) {
+	c := Chain(NewRawProto(), NewChecksumTransform())
+	p, err := c.Handshake(nil, Negotiated{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有需要协商的变换时共享同一个实例，广播时可以共享帧
+	if p != Proto(c) {
+		t.Fatal("want the same chain")
+	}
+}
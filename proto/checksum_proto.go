@@ -0,0 +1,138 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+)
+
+// ChecksumSize 校验和的长度
+const ChecksumSize = 4
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumProto 在 base 打包的帧末尾追加 CRC32C 校验和，解析前校验，
+// 用于发现中间设备或者客户端内存问题导致的数据损坏。
+// 校验和覆盖整个负载（包括元数据），双方都需要使用；
+// 只需要校验消息体或者需要和其他变换组合时，使用 ChecksumTransform。
+// 负载格式：[base 的数据][crc32c = 4]
+type ChecksumProto struct {
+	base Proto
+}
+
+var (
+	_ PoolPacker   = new(ChecksumProto)
+	_ LanePacker   = new(ChecksumProto)
+	_ Handshaker   = new(ChecksumProto)
+	_ Compressible = new(ChecksumProto)
+)
+
+// NewChecksumProto 创建一个 ChecksumProto
+func NewChecksumProto(base Proto) *ChecksumProto {
+	return &ChecksumProto{base: base}
+}
+
+func (c *ChecksumProto) Pack(m message.Message) ([]byte, error) {
+	return c.PackWith(m, nil)
+}
+
+// PackWith 使用 base 打包后追加校验和
+func (c *ChecksumProto) PackWith(m message.Message, alloc func(size int) []byte) ([]byte, error) {
+	return c.PackLaneWith(m, 0, alloc)
+}
+
+// PackLaneWith 和 PackWith 相同，lane 传递给 base
+func (c *ChecksumProto) PackLaneWith(m message.Message, lane uint8, alloc func(size int) []byte) ([]byte, error) {
+	data, err := packLane(c.base, m, lane, func(size int) []byte {
+		// 预留校验和的空间
+		var buf []byte
+		if alloc != nil {
+			buf = alloc(size + ChecksumSize)
+		} else {
+			buf = make([]byte, size+ChecksumSize)
+		}
+		return buf[:size]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	size := len(data)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[size:], crc32.Checksum(data[:size], castagnoliTable))
+	return data, nil
+}
+
+// Unpack 校验通过后，使用 base 解析，不一致时返回 code.ProtocolError
+func (c *ChecksumProto) Unpack(data []byte) (message.Message, error) {
+	if len(data) < ChecksumSize {
+		return nil, code.NewProtocolError(code.ReasonChecksum,
+			fmt.Errorf("%w: frame size %d < %d", code.ErrChecksumMismatch, len(data), ChecksumSize))
+	}
+
+	size := len(data) - ChecksumSize
+	want := binary.BigEndian.Uint32(data[size:])
+	if got := crc32.Checksum(data[:size], castagnoliTable); got != want {
+		return nil, code.NewProtocolError(code.ReasonChecksum,
+			fmt.Errorf("%w: want %08x, got %08x", code.ErrChecksumMismatch, want, got))
+	}
+	return c.base.Unpack(data[:size])
+}
+
+// Handshake 返回使用 base 协商结果的 ChecksumProto
+func (c *ChecksumProto) Handshake(rw io.ReadWriter, n Negotiated) (Proto, error) {
+	h, ok := c.base.(Handshaker)
+	if !ok {
+		return c, nil
+	}
+
+	base, err := h.Handshake(rw, n)
+	if err != nil {
+		return nil, err
+	}
+	return &ChecksumProto{base: base}, nil
+}
+
+// Compressions 返回 base 支持的压缩算法
+func (c *ChecksumProto) Compressions() []string {
+	if cp, ok := c.base.(Compressible); ok {
+		return cp.Compressions()
+	}
+	return nil
+}
+
+// ChecksumTransform 在消息体末尾追加 CRC32C 校验和的 BodyTransform，通过 FlagChecksum 标记。
+// 和 ChecksumProto 不同，只覆盖消息体，可以在 Chain 中和压缩、加密任意组合。
+type ChecksumTransform struct{}
+
+// NewChecksumTransform 创建一个 ChecksumTransform
+func NewChecksumTransform() ChecksumTransform {
+	return ChecksumTransform{}
+}
+
+func (ChecksumTransform) Encode(_, body []byte, flags uint16) ([]byte, uint16, error) {
+	data := make([]byte, len(body)+ChecksumSize)
+	copy(data, body)
+	binary.BigEndian.PutUint32(data[len(body):], crc32.Checksum(body, castagnoliTable))
+	return data, flags | FlagChecksum, nil
+}
+
+// Decode 校验并去掉校验和，缺少校验和或者不一致时返回 code.ProtocolError
+func (ChecksumTransform) Decode(_, body []byte, flags uint16) ([]byte, uint16, error) {
+	if flags&FlagChecksum == 0 || len(body) < ChecksumSize {
+		return nil, 0, code.NewProtocolError(code.ReasonChecksum,
+			fmt.Errorf("%w: checksum is missing", code.ErrChecksumMismatch))
+	}
+
+	size := len(body) - ChecksumSize
+	want := binary.BigEndian.Uint32(body[size:])
+	if got := crc32.Checksum(body[:size], castagnoliTable); got != want {
+		return nil, 0, code.NewProtocolError(code.ReasonChecksum,
+			fmt.Errorf("%w: want %08x, got %08x", code.ErrChecksumMismatch, want, got))
+	}
+	return body[:size], flags &^ FlagChecksum, nil
+}
@@ -0,0 +1,47 @@
+package proto
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/common"
+	"github.com/ywanbing/spider/message"
+)
+
+func TestChecksumProto(t *testing.T) {
+	p := NewChecksumProto(NewRawProto())
+	m := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypePush.String(),
+	}, []byte("hello world"))
+
+	pool := common.NewLimitedPool(512, 4096)
+	for _, alloc := range []func(int) []byte{nil, pool.Get} {
+		data, err := p.PackWith(m, alloc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw, _ := NewRawProto().Pack(m); len(data) != len(raw)+ChecksumSize {
+			t.Fatalf("payload size: want %d, got %d", len(raw)+ChecksumSize, len(data))
+		}
+
+		got, err := p.Unpack(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.GetBody()) != "hello world" {
+			t.Fatalf("body: got %q", got.GetBody())
+		}
+
+		// 任意一个字节损坏都需要被发现
+		for i := 0; i < len(data); i++ {
+			data[i] ^= 0x01
+			_, err = p.Unpack(data)
+			var pe *code.ProtocolError
+			if !errors.Is(err, code.ErrChecksumMismatch) || !errors.As(err, &pe) || pe.Reason != code.ReasonChecksum {
+				t.Fatalf("corrupt byte %d: got %v", i, err)
+			}
+			data[i] ^= 0x01
+		}
+	}
+}
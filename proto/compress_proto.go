@@ -0,0 +1,114 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ywanbing/spider/code"
+)
+
+// DefaultCompressThreshold 默认的压缩阈值，小于该长度的消息体不压缩
+const DefaultCompressThreshold = 1024
+
+// CompressTransform 压缩消息体的 BodyTransform。
+// 只有超过阈值的消息体才会被压缩，并且通过 FlagCompressed 标记，
+// 压缩后没有变小的消息体按原样发送。解压时根据消息体中的算法 ID 选择算法，
+// 因此可以解析对端使用任意已注册算法压缩的消息。
+// 压缩后的消息体：[compressorId = 1][data]
+type CompressTransform struct {
+	// 发送时使用的压缩算法，为 nil 时不压缩
+	compressor Compressor
+	threshold  int
+}
+
+var (
+	_ TransformHandshaker = new(CompressTransform)
+	_ Compressible        = new(CompressTransform)
+)
+
+// NewCompressTransform 创建一个使用 name 压缩算法的 CompressTransform，
+// name 没有注册时不压缩；threshold <= 0 时使用 DefaultCompressThreshold。
+func NewCompressTransform(name string, threshold int) *CompressTransform {
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	return &CompressTransform{
+		compressor: GetCompressor(name),
+		threshold:  threshold,
+	}
+}
+
+func (c *CompressTransform) Encode(_, body []byte, flags uint16) ([]byte, uint16, error) {
+	if c.compressor == nil || len(body) < c.threshold {
+		return body, flags, nil
+	}
+
+	data, err := c.compressor.Compress(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	// 压缩后没有变小，按原样发送
+	if len(data)+1 >= len(body) {
+		return body, flags, nil
+	}
+
+	compressed := make([]byte, len(data)+1)
+	compressed[0] = c.compressor.ID()
+	copy(compressed[1:], data)
+	return compressed, flags | FlagCompressed, nil
+}
+
+func (c *CompressTransform) Decode(_, body []byte, flags uint16) ([]byte, uint16, error) {
+	if flags&FlagCompressed == 0 {
+		return body, flags, nil
+	}
+
+	if len(body) == 0 {
+		return nil, 0, fmt.Errorf("%w: compressed body is empty", code.ErrMalformedFrame)
+	}
+	compressor := GetCompressorByID(body[0])
+	if compressor == nil {
+		return nil, 0, fmt.Errorf("%w: unknown compressor %d", code.ErrMalformedFrame, body[0])
+	}
+
+	body, err := compressor.Decompress(body[1:], MaxDecompressSize)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %s: %v", code.ErrMalformedFrame, compressor.Name(), err)
+	}
+	return body, flags &^ FlagCompressed, nil
+}
+
+// Compressions 返回在连接前导中声明的压缩算法，当前使用的算法优先
+func (c *CompressTransform) Compressions() []string {
+	names := make([]string, 0, 4)
+	if c.compressor != nil {
+		names = append(names, c.compressor.Name())
+	}
+	for _, name := range Compressors() {
+		if c.compressor == nil || name != c.compressor.Name() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Handshake 返回使用协商后压缩算法的 CompressTransform
+func (c *CompressTransform) Handshake(_ io.ReadWriter, n Negotiated) (BodyTransform, error) {
+	return &CompressTransform{
+		compressor: GetCompressor(n.Compression),
+		threshold:  c.threshold,
+	}, nil
+}
+
+// CompressProto 在 base 的基础上压缩消息体，等同于 Chain(base, NewCompressTransform(name, threshold))
+type CompressProto struct {
+	*ChainProto
+}
+
+// NewCompressProto 创建一个使用 name 压缩算法的 CompressProto，
+// name 没有注册时不压缩；threshold <= 0 时使用 DefaultCompressThreshold。
+func NewCompressProto(base Proto, name string, threshold int) *CompressProto {
+	return &CompressProto{
+		ChainProto: Chain(base, NewCompressTransform(name, threshold)),
+	}
+}
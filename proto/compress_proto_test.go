@@ -0,0 +1,111 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ywanbing/spider/message"
+)
+
+func TestCompressProto(t *testing.T) {
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+
+	tests := []struct {
+		name       string
+		body       []byte
+		compressed bool
+	}{
+		{"empty", nil, false},
+		{"below-threshold", bytes.Repeat([]byte("a"), 100), false},
+		{"compressible", bytes.Repeat([]byte("spider"), 1024), true},
+		{"incompressible", random, false},
+	}
+
+	for _, name := range Compressors() {
+		p := NewCompressProto(NewRawProto(), name, 0)
+		for _, tt := range tests {
+			t.Run(name+"-"+tt.name, func(t *testing.T) {
+				m := message.NewMessage(1, 'R', map[string]string{
+					message.MsgTypeKey: message.MsgTypePush.String(),
+				}, tt.body)
+
+				data, err := p.Pack(m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compressed := len(data) < HeaderSize+len(tt.body); compressed != tt.compressed {
+					t.Fatalf("compressed: want %v, got %v", tt.compressed, compressed)
+				}
+
+				// 不压缩的 Proto 也可以解析对端压缩的消息
+				got, err := NewCompressProto(NewRawProto(), "", 0).Unpack(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got.GetBody(), tt.body) || got.GetFlags()&FlagCompressed != 0 {
+					t.Fatal("body mismatch")
+				}
+			})
+		}
+	}
+}
+
+func TestCompressProto_Handshake(t *testing.T) {
+	p := NewCompressProto(NewRawProto(), GzipCompressorName, 0)
+	if names := p.Compressions(); names[0] != GzipCompressorName || len(names) != len(Compressors()) {
+		t.Fatalf("compressions: got %v", names)
+	}
+
+	hp, err := p.Handshake(nil, Negotiated{Compression: ZstdCompressorName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := hp.(*ChainProto).transforms[0].(*CompressTransform).compressor; c == nil || c.Name() != ZstdCompressorName {
+		t.Fatalf("negotiated compressor: got %v", c)
+	}
+}
+
+func TestCompressProto_MaxDecompressSize(t *testing.T) {
+	body := bytes.Repeat([]byte("spider"), 1024)
+	defer func(size int) { MaxDecompressSize = size }(MaxDecompressSize)
+
+	for _, name := range Compressors() {
+		t.Run(name, func(t *testing.T) {
+			p := NewCompressProto(NewRawProto(), name, 0)
+			data, err := p.Pack(message.NewMessage(1, 'R', map[string]string{
+				message.MsgTypeKey: message.MsgTypePush.String(),
+			}, body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			MaxDecompressSize = len(body)
+			if _, err = p.Unpack(data); err != nil {
+				t.Fatal(err)
+			}
+			// 修改后立即生效
+			MaxDecompressSize = len(body) - 1
+			if _, err = p.Unpack(data); err == nil {
+				t.Fatal("body larger than MaxDecompressSize should be rejected")
+			}
+		})
+	}
+}
+
+func TestZstdCompressor_NoContentSize(t *testing.T) {
+	// 流式压缩的帧头没有解压后的长度，只能在解压时限制
+	var buf bytes.Buffer
+	w, _ := zstd.NewWriter(&buf)
+	_, _ = w.Write(bytes.Repeat([]byte("spider"), 1024))
+	_ = w.Close()
+
+	if _, err := (ZstdCompressor{}).Decompress(buf.Bytes(), 6*1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (ZstdCompressor{}).Decompress(buf.Bytes(), 6*1024-1); err == nil {
+		t.Fatal("body larger than maxSize should be rejected")
+	}
+}
@@ -0,0 +1,68 @@
+package proto
+
+import (
+	"errors"
+	"sync"
+)
+
+// MaxDecompressSize 解压后消息体的最大长度，避免压缩炸弹。默认值：64M。
+var MaxDecompressSize = 64 * 1024 * 1024
+
+// Compressor 消息体压缩算法
+type Compressor interface {
+	// Name 算法名称，用于连接前导中的协商
+	Name() string
+	// ID 算法标识，写入压缩后消息体的第一个字节
+	ID() byte
+	// Compress 压缩数据
+	Compress(data []byte) ([]byte, error)
+	// Decompress 解压数据，解压后超过 maxSize 时返回错误
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	compressorLock    sync.RWMutex
+	compressorManager = make(map[string]Compressor)
+	compressorByID    = make(map[byte]Compressor)
+	// 注册顺序，也是默认的协商优先级
+	compressorNames []string
+)
+
+// RegisterCompressor 注册压缩算法，名称和 ID 都不能重复
+func RegisterCompressor(c Compressor) error {
+	compressorLock.Lock()
+	defer compressorLock.Unlock()
+
+	if _, ok := compressorManager[c.Name()]; ok {
+		return errors.New("compressor already registered")
+	}
+	if _, ok := compressorByID[c.ID()]; ok {
+		return errors.New("compressor id already registered")
+	}
+
+	compressorManager[c.Name()] = c
+	compressorByID[c.ID()] = c
+	compressorNames = append(compressorNames, c.Name())
+	return nil
+}
+
+// GetCompressor 通过名称获取压缩算法，不存在时返回 nil
+func GetCompressor(name string) Compressor {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	return compressorManager[name]
+}
+
+// GetCompressorByID 通过 ID 获取压缩算法，不存在时返回 nil
+func GetCompressorByID(id byte) Compressor {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	return compressorByID[id]
+}
+
+// Compressors 返回所有已注册的压缩算法名称，按注册顺序排序
+func Compressors() []string {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	return append([]string(nil), compressorNames...)
+}
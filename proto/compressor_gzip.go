@@ -0,0 +1,64 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const GzipCompressorName = "gzip"
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// GzipCompressor 基于标准库的 gzip 压缩
+type GzipCompressor struct{}
+
+func (GzipCompressor) Name() string {
+	return GzipCompressorName
+}
+
+func (GzipCompressor) ID() byte {
+	return 1
+}
+
+func (GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	res, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > maxSize {
+		return nil, fmt.Errorf("decompressed size exceeds %d", maxSize)
+	}
+	return res, nil
+}
+
+func init() {
+	_ = RegisterCompressor(GzipCompressor{})
+}
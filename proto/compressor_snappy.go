@@ -0,0 +1,39 @@
+package proto
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/s2"
+)
+
+const SnappyCompressorName = "snappy"
+
+// SnappyCompressor snappy 块格式压缩，纯 Go 实现
+type SnappyCompressor struct{}
+
+func (SnappyCompressor) Name() string {
+	return SnappyCompressorName
+}
+
+func (SnappyCompressor) ID() byte {
+	return 2
+}
+
+func (SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	return s2.EncodeSnappy(nil, data), nil
+}
+
+func (SnappyCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	size, err := s2.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("decompressed size exceeds %d", maxSize)
+	}
+	return s2.Decode(nil, data)
+}
+
+func init() {
+	_ = RegisterCompressor(SnappyCompressor{})
+}
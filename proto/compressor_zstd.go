@@ -0,0 +1,70 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const ZstdCompressorName = "zstd"
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	// 流式解压，每次调用按照 maxSize 限制解压后的长度
+	zstdDecoderPool = sync.Pool{
+		New: func() any {
+			d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+			return d
+		},
+	}
+)
+
+// ZstdCompressor zstd 压缩，纯 Go 实现
+type ZstdCompressor struct{}
+
+func (ZstdCompressor) Name() string {
+	return ZstdCompressorName
+}
+
+func (ZstdCompressor) ID() byte {
+	return 3
+}
+
+func (ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func (ZstdCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	var h zstd.Header
+	if err := h.Decode(data); err != nil {
+		return nil, err
+	}
+	if h.HasFCS && h.FrameContentSize > uint64(maxSize) {
+		return nil, fmt.Errorf("decompressed size exceeds %d", maxSize)
+	}
+
+	d := zstdDecoderPool.Get().(*zstd.Decoder)
+	defer func() {
+		// 释放对 data 的引用
+		_ = d.Reset(nil)
+		zstdDecoderPool.Put(d)
+	}()
+	if err := d.Reset(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	res, err := io.ReadAll(io.LimitReader(d, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > maxSize {
+		return nil, fmt.Errorf("decompressed size exceeds %d", maxSize)
+	}
+	return res, nil
+}
+
+func init() {
+	_ = RegisterCompressor(ZstdCompressor{})
+}
@@ -0,0 +1,262 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/ywanbing/spider/code"
+)
+
+// CipherSuite 消息体加密使用的 AEAD 算法
+type CipherSuite byte
+
+const (
+	CipherAES256GCM        CipherSuite = 1
+	CipherChaCha20Poly1305 CipherSuite = 2
+)
+
+const (
+	// 计数器的长度，写在密文之前
+	counterSize = 8
+	// 计数器的最高字节为 lane，每个 lane 使用独立的计数器和重放窗口
+	laneShift = 56
+	// 支持的 lane 数量
+	maxLanes = 8
+)
+
+// EncryptTransform 加密消息体的 BodyTransform，用于无法使用 TLS 的场景。
+// 需要开启 WithHandshake，在连接前导阶段通过 X25519 交换密钥，
+// 每个方向使用独立的密钥和递增的计数器作为 nonce，接收方通过滑动窗口拒绝重放的帧。
+// 发送队列会按照优先级重新排序，因此每个 lane 使用独立的计数器和窗口，见 LanePacker。
+// 只加密消息体，元数据不加密，但是和帧标志位一起作为附加数据认证，被修改时解密失败。
+// 加密后的消息体：[lane = 1][counter = 7][ciphertext]
+type EncryptTransform struct {
+	suite CipherSuite
+
+	// 握手完成后生成
+	send        cipher.AEAD
+	recv        cipher.AEAD
+	sendCounter [maxLanes]atomic.Uint64
+	replay      [maxLanes]replayWindow
+}
+
+var (
+	_ TransformHandshaker = new(EncryptTransform)
+	_ LaneEncoder         = new(EncryptTransform)
+)
+
+// NewEncryptTransform 创建一个 EncryptTransform，双方需要使用相同的 suite
+func NewEncryptTransform(suite CipherSuite) *EncryptTransform {
+	return &EncryptTransform{suite: suite}
+}
+
+// Handshake 交换 X25519 公钥并生成该连接的加密密钥。
+// 交换的数据：[suite = 1][publicKey = 32]
+func (e *EncryptTransform) Handshake(rw io.ReadWriter, _ Negotiated) (BodyTransform, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = rw.Write(append([]byte{byte(e.suite)}, public...)); err != nil {
+		return nil, err
+	}
+	peer := make([]byte, 1+curve25519.PointSize)
+	if _, err = io.ReadFull(rw, peer); err != nil {
+		return nil, err
+	}
+	if CipherSuite(peer[0]) != e.suite {
+		return nil, fmt.Errorf("%w: local %d, peer %d", code.ErrCipherMismatch, e.suite, peer[0])
+	}
+	peerPublic := peer[1:]
+
+	shared, err := curve25519.X25519(private, peerPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", code.ErrKeyExchange, err)
+	}
+
+	// 按公钥大小排序，双方得到相同的盐和方向
+	first, second := public, peerPublic
+	cmp := bytes.Compare(public, peerPublic)
+	if cmp == 0 {
+		return nil, fmt.Errorf("%w: same public key", code.ErrKeyExchange)
+	}
+	if cmp > 0 {
+		first, second = peerPublic, public
+	}
+	salt := append(append([]byte(nil), first...), second...)
+
+	keyA, err := e.newAEAD(shared, salt, "spider a->b")
+	if err != nil {
+		return nil, err
+	}
+	keyB, err := e.newAEAD(shared, salt, "spider b->a")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &EncryptTransform{suite: e.suite, send: keyA, recv: keyB}
+	if cmp > 0 {
+		res.send, res.recv = keyB, keyA
+	}
+	return res, nil
+}
+
+// newAEAD 通过 HKDF 派生密钥并创建 AEAD
+func (e *EncryptTransform) newAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+
+	switch e.suite {
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("%w: unknown cipher suite %d", code.ErrCipherMismatch, e.suite)
+	}
+}
+
+func (e *EncryptTransform) Encode(header, body []byte, flags uint16) ([]byte, uint16, error) {
+	return e.EncodeLane(header, body, flags, 0)
+}
+
+// EncodeLane 使用 lane 的计数器加密消息体
+func (e *EncryptTransform) EncodeLane(header, body []byte, flags uint16, lane uint8) ([]byte, uint16, error) {
+	if e.send == nil {
+		return nil, 0, code.ErrNotHandshaken
+	}
+	if lane >= maxLanes {
+		return nil, 0, fmt.Errorf("encrypt: lane %d out of range", lane)
+	}
+
+	counter := uint64(lane)<<laneShift | e.sendCounter[lane].Add(1)
+	sealed := make([]byte, counterSize, counterSize+len(body)+e.send.Overhead())
+	binary.BigEndian.PutUint64(sealed, counter)
+	sealed = e.send.Seal(sealed, nonce(e.send, counter), body, additionalData(header, flags))
+	return sealed, flags | FlagEncrypted, nil
+}
+
+// Decode 解密消息体，解密失败、头部被修改或者重放的帧返回 code.ProtocolError
+func (e *EncryptTransform) Decode(header, body []byte, flags uint16) ([]byte, uint16, error) {
+	if e.recv == nil {
+		return nil, 0, code.ErrNotHandshaken
+	}
+	if flags&FlagEncrypted == 0 || len(body) < counterSize+e.recv.Overhead() {
+		return nil, 0, code.NewProtocolError(code.ReasonDecrypt,
+			fmt.Errorf("%w: frame is not encrypted", code.ErrDecryptFailed))
+	}
+
+	counter := binary.BigEndian.Uint64(body)
+	lane := counter >> laneShift
+	if lane >= maxLanes {
+		return nil, 0, code.NewProtocolError(code.ReasonDecrypt,
+			fmt.Errorf("%w: lane %d out of range", code.ErrDecryptFailed, lane))
+	}
+
+	replay := &e.replay[lane]
+	replay.mu.Lock()
+	defer replay.mu.Unlock()
+	if !replay.check(counter) {
+		return nil, 0, code.NewProtocolError(code.ReasonReplay,
+			fmt.Errorf("%w: counter %d", code.ErrReplayedFrame, counter))
+	}
+
+	plain, err := e.recv.Open(nil, nonce(e.recv, counter), body[counterSize:], additionalData(header, flags))
+	if err != nil {
+		return nil, 0, code.NewProtocolError(code.ReasonDecrypt, fmt.Errorf("%w: %v", code.ErrDecryptFailed, err))
+	}
+	replay.accept(counter)
+	return plain, flags &^ FlagEncrypted, nil
+}
+
+// nonce 使用计数器生成 nonce，每个方向使用独立的密钥，因此不会重复
+func nonce(aead cipher.AEAD, counter uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-counterSize:], counter)
+	return n
+}
+
+// additionalData 返回认证的附加数据：头部和加密前的帧标志位。
+// FlagBinaryHeader 由 base 设置，不参与认证。
+func additionalData(header []byte, flags uint16) []byte {
+	return binary.BigEndian.AppendUint16(header[:len(header):len(header)], flags&^(FlagEncrypted|FlagBinaryHeader))
+}
+
+// EncryptedProto 在 base 的基础上加密消息体，等同于 Chain(base, NewEncryptTransform(suite))。
+// 需要开启 WithHandshake。和压缩一起使用时，需要先压缩再加密。
+type EncryptedProto struct {
+	*ChainProto
+}
+
+// NewEncryptedProto 创建一个 EncryptedProto，双方需要使用相同的 suite
+func NewEncryptedProto(base Proto, suite CipherSuite) *EncryptedProto {
+	return &EncryptedProto{
+		ChainProto: Chain(base, NewEncryptTransform(suite)),
+	}
+}
+
+// replayWindowSize 重放窗口的大小。
+// 连接在同一个 lane 内按照打包的顺序发送，丢弃的帧只留下空洞；
+// 窗口只用来容忍在连接之外打包再写入的少量乱序，超过窗口的乱序会被当作重放。
+const replayWindowSize = 64
+
+// replayWindow 接收计数器的滑动窗口
+type replayWindow struct {
+	mu     sync.Mutex
+	max    uint64
+	bitmap uint64
+}
+
+// check 计数器是否可以接收
+func (w *replayWindow) check(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > w.max {
+		return true
+	}
+	diff := w.max - counter
+	if diff >= replayWindowSize {
+		return false
+	}
+	return w.bitmap&(1<<diff) == 0
+}
+
+// accept 记录已经接收的计数器，需要先通过 check
+func (w *replayWindow) accept(counter uint64) {
+	if counter > w.max {
+		diff := counter - w.max
+		if diff >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= diff
+		}
+		w.bitmap |= 1
+		w.max = counter
+		return
+	}
+	w.bitmap |= 1 << (w.max - counter)
+}
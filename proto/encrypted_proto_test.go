@@ -0,0 +1,186 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+)
+
+// handshakePair 在一对本地连接上完成握手
+func handshakePair(t *testing.T, a, b Handshaker) (Proto, Proto, error) {
+	t.Helper()
+	// 握手时双方先写后读，需要带缓冲的连接，不能使用 net.Pipe
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ca, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Close()
+	cb, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cb.Close()
+
+	type result struct {
+		p   Proto
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		p, err := b.Handshake(cb, Negotiated{Compression: ZstdCompressorName})
+		if err != nil {
+			// 让对端的读取返回
+			_ = cb.Close()
+		}
+		res <- result{p, err}
+	}()
+
+	pa, err := a.Handshake(ca, Negotiated{Compression: ZstdCompressorName})
+	if err != nil {
+		_ = ca.Close()
+	}
+	r := <-res
+	if err == nil {
+		err = r.err
+	}
+	return pa, r.p, err
+}
+
+func TestEncryptedProto(t *testing.T) {
+	for _, suite := range []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305} {
+		pa, pb, err := handshakePair(t, NewEncryptedProto(NewRawProto(), suite), NewEncryptedProto(NewRawProto(), suite))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := message.NewMessage(1, 'R', map[string]string{
+			message.MsgTypeKey: message.MsgTypePush.String(),
+		}, []byte("hello world"))
+
+		// 双向收发，乱序的帧在窗口内可以接收
+		for _, pair := range [][2]Proto{{pa, pb}, {pb, pa}} {
+			first, _ := pair[0].Pack(m)
+			second, _ := pair[0].Pack(m)
+			for _, data := range [][]byte{second, first} {
+				got, err := pair[1].Unpack(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got.GetBody()) != "hello world" {
+					t.Fatalf("body: got %q", got.GetBody())
+				}
+			}
+
+			// 重放
+			if _, err = pair[1].Unpack(first); !errors.Is(err, code.ErrReplayedFrame) {
+				t.Fatalf("replay: got %v", err)
+			}
+
+			// 篡改
+			data, _ := pair[0].Pack(m)
+			data[len(data)-1] ^= 0xff
+			_, err = pair[1].Unpack(data)
+			var pe *code.ProtocolError
+			if !errors.Is(err, code.ErrDecryptFailed) || !errors.As(err, &pe) || pe.Reason != code.ReasonDecrypt {
+				t.Fatalf("tamper: got %v", err)
+			}
+		}
+
+		// 明文的帧
+		data, _ := NewRawProto().Pack(m)
+		if _, err = pb.Unpack(data); !errors.Is(err, code.ErrDecryptFailed) {
+			t.Fatalf("plaintext: got %v", err)
+		}
+	}
+}
+
+func TestEncryptedProto_CipherMismatch(t *testing.T) {
+	_, _, err := handshakePair(t,
+		NewEncryptedProto(NewRawProto(), CipherAES256GCM),
+		NewEncryptedProto(NewRawProto(), CipherChaCha20Poly1305))
+	if !errors.Is(err, code.ErrCipherMismatch) {
+		t.Fatalf("want ErrCipherMismatch, got %v", err)
+	}
+
+	if _, err = NewEncryptedProto(NewRawProto(), CipherAES256GCM).Pack(message.NewMsgWithMsgID(1)); !errors.Is(err, code.ErrNotHandshaken) {
+		t.Fatalf("want ErrNotHandshaken, got %v", err)
+	}
+}
+
+func TestEncryptedProto_Lane(t *testing.T) {
+	pa, pb, err := handshakePair(t, NewEncryptedProto(NewRawProto(), CipherAES256GCM), NewEncryptedProto(NewRawProto(), CipherAES256GCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypePush.String(),
+	}, []byte("hello world"))
+
+	// 每个 lane 使用独立的窗口，超过窗口大小的 lane 之间的乱序可以接收
+	var normal [][]byte
+	for i := 0; i < replayWindowSize*2; i++ {
+		data, _ := pa.(LanePacker).PackLaneWith(m, 1, nil)
+		normal = append(normal, data)
+	}
+	high, _ := pa.(LanePacker).PackLaneWith(m, 0, nil)
+	for _, data := range append([][]byte{high}, normal...) {
+		if _, err = pb.Unpack(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 重放
+	if _, err = pb.Unpack(normal[len(normal)-1]); !errors.Is(err, code.ErrReplayedFrame) {
+		t.Fatalf("replay: got %v", err)
+	}
+	if _, err = pa.(LanePacker).PackLaneWith(m, maxLanes, nil); err == nil {
+		t.Fatal("lane out of range should be rejected")
+	}
+}
+
+func TestEncryptedProto_TamperHeader(t *testing.T) {
+	pa, pb, err := handshakePair(t, NewEncryptedProto(NewRawProto(), CipherAES256GCM), NewEncryptedProto(NewRawProto(), CipherAES256GCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypeRequest.String(),
+		message.MsgSeq:     "1",
+	}, []byte("hello world"))
+
+	tampers := map[string]func(data []byte){
+		"msg-id":       func(data []byte) { data[3] ^= 0x01 },
+		"marshal-type": func(data []byte) { data[4] ^= 0x01 },
+		"metadata": func(data []byte) {
+			i := bytes.Index(data, []byte(`"msg_seq":"1"`))
+			data[i+len(`"msg_seq":"`)] = '2'
+		},
+	}
+	for name, tamper := range tampers {
+		t.Run(name, func(t *testing.T) {
+			data, err := pa.Pack(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tamper(data)
+			if _, err = pb.Unpack(data); !errors.Is(err, code.ErrDecryptFailed) {
+				t.Fatalf("want ErrDecryptFailed, got %v", err)
+			}
+		})
+	}
+
+	// 未修改的帧可以正常解密
+	data, _ := pa.Pack(m)
+	if _, err = pb.Unpack(data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,291 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ywanbing/spider/code"
+)
+
+// Framer 负责在字节流中划分帧，Proto 只处理帧的负载。
+type Framer interface {
+	// ReadFrame 读取一个帧，返回去掉长度字段、分隔符后的负载。
+	// 连接在同一个协程中调用，r 实现了 io.ByteReader。
+	ReadFrame(r io.Reader) ([]byte, error)
+	// WriteFrame 将 payload 作为一个帧写入 w
+	WriteFrame(w io.Writer, payload []byte) error
+}
+
+// FrameLimiter 可以由 Framer 实现，由连接设置负载的最大长度和内存分配方式。
+// 负载超过最大长度时，ReadFrame 需要在分配内存之前返回 code.ProtocolError。
+type FrameLimiter interface {
+	// WithLimit 返回使用 maxSize 和 alloc 的 Framer，maxSize 为 0 时不限制，alloc 为 nil 时直接分配。
+	WithLimit(maxSize uint32, alloc func(size int) []byte) Framer
+}
+
+// PrefixFramer 可以由 Framer 实现，帧头长度固定并且没有帧尾时，
+// 连接打包时直接在负载前预留帧头，避免拷贝负载。
+type PrefixFramer interface {
+	// PrefixSize 返回帧头的长度
+	PrefixSize() int
+	// PutPrefix 将负载长度为 size 的帧头写入 dst
+	PutPrefix(dst []byte, size int) error
+}
+
+var (
+	_ FrameLimiter = new(LengthFramer)
+	_ PrefixFramer = new(LengthFramer)
+	_ FrameLimiter = new(UvarintFramer)
+	_ FrameLimiter = new(DelimiterFramer)
+)
+
+// frameLimit 负载的最大长度和内存分配方式
+type frameLimit struct {
+	maxSize uint32
+	alloc   func(size int) []byte
+}
+
+func (l frameLimit) check(size uint64) error {
+	if l.maxSize > 0 && size > uint64(l.maxSize) {
+		return code.NewProtocolError(code.ReasonFrameTooLarge,
+			fmt.Errorf("%w: %d > %d", code.ErrFrameTooLarge, size, l.maxSize))
+	}
+	return nil
+}
+
+func (l frameLimit) allocate(size int) []byte {
+	if l.alloc != nil {
+		return l.alloc(size)
+	}
+	return make([]byte, size)
+}
+
+// readPayload 检查长度后分配并读取负载
+func (l frameLimit) readPayload(r io.Reader, size uint64) ([]byte, error) {
+	if err := l.check(size); err != nil {
+		return nil, err
+	}
+	data := l.allocate(int(size))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// LengthFramer 使用固定长度的长度字段划分帧。
+// 帧格式：[length = width][payload]
+type LengthFramer struct {
+	frameLimit
+
+	width        int
+	littleEndian bool
+	// 长度字段的值是否包括长度字段本身
+	includeSelf bool
+}
+
+// NewDefaultFramer 创建默认的 Framer：4 字节大端的长度字段，长度包括长度字段本身。
+func NewDefaultFramer() *LengthFramer {
+	return NewLengthFramer(MsgSize, binary.BigEndian, true)
+}
+
+// NewLengthFramer 创建一个 LengthFramer，width 只能是 1，2，4，8。
+// includeSelf 表示长度字段的值是否包括长度字段本身。
+func NewLengthFramer(width int, order binary.ByteOrder, includeSelf bool) *LengthFramer {
+	switch width {
+	case 1, 2, 4, 8:
+	default:
+		panic(fmt.Sprintf("invalid length field width %d", width))
+	}
+	return &LengthFramer{
+		width:        width,
+		littleEndian: order == binary.LittleEndian,
+		includeSelf:  includeSelf,
+	}
+}
+
+func (f *LengthFramer) WithLimit(maxSize uint32, alloc func(size int) []byte) Framer {
+	c := *f
+	c.frameLimit = frameLimit{maxSize: maxSize, alloc: alloc}
+	return &c
+}
+
+func (f *LengthFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	br := asByteReader(r)
+
+	var size uint64
+	for i := 0; i < f.width; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if f.littleEndian {
+			size |= uint64(b) << (8 * i)
+		} else {
+			size = size<<8 | uint64(b)
+		}
+	}
+
+	if f.includeSelf {
+		if size < uint64(f.width) {
+			return nil, code.NewProtocolError(code.ReasonFrameTooSmall,
+				fmt.Errorf("%w: %d < %d", code.ErrFrameTooSmall, size, f.width))
+		}
+		size -= uint64(f.width)
+	}
+	return f.readPayload(r, size)
+}
+
+func (f *LengthFramer) WriteFrame(w io.Writer, payload []byte) error {
+	var head [8]byte
+	if err := f.PutPrefix(head[:f.width], len(payload)); err != nil {
+		return err
+	}
+	if _, err := w.Write(head[:f.width]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func (f *LengthFramer) PrefixSize() int {
+	return f.width
+}
+
+// PutPrefix 写入长度字段，长度超过长度字段能表示的范围时返回 code.ErrFrameTooLarge
+func (f *LengthFramer) PutPrefix(dst []byte, size int) error {
+	length := uint64(size)
+	if f.includeSelf {
+		length += uint64(f.width)
+	}
+	if f.width < 8 && length >= 1<<(8*f.width) {
+		return fmt.Errorf("%w: %d overflows %d bytes length field", code.ErrFrameTooLarge, size, f.width)
+	}
+
+	for i := 0; i < f.width; i++ {
+		if f.littleEndian {
+			dst[i] = byte(length >> (8 * i))
+		} else {
+			dst[f.width-1-i] = byte(length >> (8 * i))
+		}
+	}
+	return nil
+}
+
+// UvarintFramer 使用 uvarint 编码的长度字段划分帧，长度不包括长度字段本身。
+// 帧格式：[length = uvarint][payload]
+type UvarintFramer struct {
+	frameLimit
+}
+
+// NewUvarintFramer 创建一个 UvarintFramer
+func NewUvarintFramer() *UvarintFramer {
+	return &UvarintFramer{}
+}
+
+func (f *UvarintFramer) WithLimit(maxSize uint32, alloc func(size int) []byte) Framer {
+	return &UvarintFramer{frameLimit: frameLimit{maxSize: maxSize, alloc: alloc}}
+}
+
+func (f *UvarintFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(asByteReader(r))
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return nil, code.NewProtocolError(code.ReasonMalformed,
+			fmt.Errorf("%w: length: %v", code.ErrMalformedFrame, err))
+	}
+	return f.readPayload(r, size)
+}
+
+func (f *UvarintFramer) WriteFrame(w io.Writer, payload []byte) error {
+	var head [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(head[:], uint64(len(payload)))
+	if _, err := w.Write(head[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// DelimiterFramer 使用分隔符划分帧，常用于文本协议的设备。
+// 负载中不能包含分隔符，需要搭配不会产生分隔符的 Proto 使用。
+// 帧格式：[payload][delim]
+type DelimiterFramer struct {
+	frameLimit
+
+	delim []byte
+}
+
+// NewDelimiterFramer 创建一个 DelimiterFramer，delim 不能为空。
+func NewDelimiterFramer(delim []byte) *DelimiterFramer {
+	if len(delim) == 0 {
+		panic("empty frame delimiter")
+	}
+	return &DelimiterFramer{delim: append([]byte(nil), delim...)}
+}
+
+func (f *DelimiterFramer) WithLimit(maxSize uint32, alloc func(size int) []byte) Framer {
+	return &DelimiterFramer{frameLimit: frameLimit{maxSize: maxSize, alloc: alloc}, delim: f.delim}
+}
+
+func (f *DelimiterFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	br := asByteReader(r)
+
+	data := f.allocate(0)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			if len(data) > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		data = append(data, b)
+
+		if bytes.HasSuffix(data, f.delim) {
+			return data[:len(data)-len(f.delim)], nil
+		}
+		// 末尾可能是分隔符的一部分
+		if n := len(data) - len(f.delim) + 1; n > 0 {
+			if err = f.check(uint64(n)); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// WriteFrame 写入负载和分隔符，负载中包含分隔符时返回 code.ErrMalformedFrame
+func (f *DelimiterFramer) WriteFrame(w io.Writer, payload []byte) error {
+	if bytes.Contains(payload, f.delim) {
+		return fmt.Errorf("%w: payload contains the delimiter", code.ErrMalformedFrame)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	_, err := w.Write(f.delim)
+	return err
+}
+
+// asByteReader 连接读取时使用 bufio.Reader，其他的 io.Reader 每次读取一个字节
+func asByteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return &singleByteReader{r: r}
+}
+
+type singleByteReader struct {
+	r io.Reader
+	b [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(s.r, s.b[:])
+	return s.b[0], err
+}
@@ -0,0 +1,68 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ywanbing/spider/code"
+)
+
+func TestFramer(t *testing.T) {
+	tests := []struct {
+		name   string
+		framer Framer
+		// payload 为 "ab" 时的帧
+		frame []byte
+	}{
+		{"default", NewDefaultFramer(), []byte{0, 0, 0, 6, 'a', 'b'}},
+		{"length-2-le", NewLengthFramer(2, binary.LittleEndian, false), []byte{2, 0, 'a', 'b'}},
+		{"length-1", NewLengthFramer(1, binary.BigEndian, true), []byte{3, 'a', 'b'}},
+		{"uvarint", NewUvarintFramer(), []byte{2, 'a', 'b'}},
+		{"delimiter", NewDelimiterFramer([]byte("\r\n")), []byte("ab\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			for i := 0; i < 2; i++ {
+				if err := tt.framer.WriteFrame(&buf, []byte("ab")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(buf.Bytes(), append(append([]byte(nil), tt.frame...), tt.frame...)) {
+				t.Fatalf("frame: got %v", buf.Bytes())
+			}
+
+			// 使用 bufio.Reader 和不支持 io.ByteReader 的 io.Reader 读取
+			for _, r := range []io.Reader{bufio.NewReader(bytes.NewReader(buf.Bytes())), io.LimitReader(bytes.NewReader(buf.Bytes()), 1<<10)} {
+				for i := 0; i < 2; i++ {
+					payload, err := tt.framer.ReadFrame(r)
+					if err != nil || string(payload) != "ab" {
+						t.Fatalf("read frame %d: got %q, %v", i, payload, err)
+					}
+				}
+				if _, err := tt.framer.ReadFrame(r); err != io.EOF {
+					t.Fatalf("want io.EOF, got %v", err)
+				}
+			}
+
+			// 超过最大长度
+			limited := tt.framer.(FrameLimiter).WithLimit(1, nil)
+			_, err := limited.ReadFrame(bytes.NewReader(tt.frame))
+			var pe *code.ProtocolError
+			if !errors.As(err, &pe) || pe.Reason != code.ReasonFrameTooLarge {
+				t.Fatalf("limit: got %v", err)
+			}
+		})
+	}
+}
+
+func TestLengthFramer_Overflow(t *testing.T) {
+	f := NewLengthFramer(1, binary.BigEndian, false)
+	if err := f.WriteFrame(io.Discard, make([]byte, 256)); !errors.Is(err, code.ErrFrameTooLarge) {
+		t.Fatalf("want ErrFrameTooLarge, got %v", err)
+	}
+}
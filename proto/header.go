@@ -0,0 +1,110 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+)
+
+// 二进制元数据中常用 key 的 1 字节标签，0 表示自定义的 key。
+// 编码格式：[tag = 1][keyLen = uvarint, key（仅 tag 为 0 时）][valueLen = uvarint, value]...
+const (
+	headerTagCustom byte = iota
+	headerTagMsgType
+	headerTagMsgSeq
+	headerTagMsgErr
+)
+
+var (
+	headerKeyToTag = map[string]byte{
+		message.MsgTypeKey: headerTagMsgType,
+		message.MsgSeq:     headerTagMsgSeq,
+		message.MsgErr:     headerTagMsgErr,
+	}
+	headerTagToKey = map[byte]string{
+		headerTagMsgType: message.MsgTypeKey,
+		headerTagMsgSeq:  message.MsgSeq,
+		headerTagMsgErr:  message.MsgErr,
+	}
+)
+
+// binaryHeaderSize 返回元数据二进制编码后的长度
+func binaryHeaderSize(md map[string]string) int {
+	size := 0
+	for k, v := range md {
+		size++
+		if _, ok := headerKeyToTag[k]; !ok {
+			size += uvarintSize(len(k)) + len(k)
+		}
+		size += uvarintSize(len(v)) + len(v)
+	}
+	return size
+}
+
+// putBinaryHeader 将元数据编码到 dst 中，dst 的长度需要等于 binaryHeaderSize
+func putBinaryHeader(dst []byte, md map[string]string) {
+	n := 0
+	for k, v := range md {
+		tag, ok := headerKeyToTag[k]
+		dst[n] = tag
+		n++
+		if !ok {
+			n += binary.PutUvarint(dst[n:], uint64(len(k)))
+			n += copy(dst[n:], k)
+		}
+		n += binary.PutUvarint(dst[n:], uint64(len(v)))
+		n += copy(dst[n:], v)
+	}
+}
+
+// parseBinaryHeader 解析二进制编码的元数据
+func parseBinaryHeader(data []byte) (map[string]string, error) {
+	md := make(map[string]string, 4)
+	for len(data) > 0 {
+		tag := data[0]
+		data = data[1:]
+
+		var (
+			key string
+			err error
+		)
+		if tag == headerTagCustom {
+			if key, data, err = readHeaderString(data); err != nil {
+				return nil, err
+			}
+		} else {
+			var ok bool
+			if key, ok = headerTagToKey[tag]; !ok {
+				return nil, fmt.Errorf("%w: unknown metadata tag %d", code.ErrMalformedFrame, tag)
+			}
+		}
+
+		var value string
+		if value, data, err = readHeaderString(data); err != nil {
+			return nil, err
+		}
+		md[key] = value
+	}
+	return md, nil
+}
+
+// readHeaderString 读取一个 uvarint 长度前缀的字符串
+func readHeaderString(data []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return "", nil, fmt.Errorf("%w: truncated metadata", code.ErrMalformedFrame)
+	}
+	data = data[n:]
+	return string(data[:size]), data[size:], nil
+}
+
+func uvarintSize(x int) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
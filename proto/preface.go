@@ -0,0 +1,192 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/codec"
+)
+
+const (
+	// ProtoVersion 当前的协议版本
+	ProtoVersion uint16 = 1
+	// MinProtoVersion 支持的最小协议版本，低于该版本的对端会被拒绝
+	MinProtoVersion uint16 = 1
+)
+
+// PrefaceMagic 连接前导的魔数
+var PrefaceMagic = [4]byte{'S', 'P', 'D', 'R'}
+
+// Preface 连接建立后双方交换的前导信息，用于协商协议版本和能力。
+// 格式：
+// magic = 4
+// version = 2
+// flags = 2（保留）
+// maxFrameSize = 4
+// heartbeatInterval = 4（毫秒）
+// codecNum = 1, codecs = codecNum
+// compressionNum = 1, [nameLen = 1, name]...
+type Preface struct {
+	// Version 协议版本
+	Version uint16
+	// Codecs 支持的序列化类型
+	Codecs []codec.MarshalType
+	// Compressions 支持的压缩算法，按优先级排序
+	Compressions []string
+	// MaxFrameSize 能够接收的最大帧长度
+	MaxFrameSize uint32
+	// HeartbeatInterval 心跳间隔，0 表示不开启
+	HeartbeatInterval time.Duration
+}
+
+// Negotiated 协商后的连接参数
+type Negotiated struct {
+	// Version 双方都支持的协议版本
+	Version uint16
+	// Codecs 双方都支持的序列化类型
+	Codecs []codec.MarshalType
+	// Compression 使用的压缩算法，为空表示不压缩
+	Compression string
+	// MaxFrameSize 双方都能接收的最大帧长度
+	MaxFrameSize uint32
+	// HeartbeatInterval 心跳间隔，取双方的最大值
+	HeartbeatInterval time.Duration
+}
+
+// WritePreface 写入前导信息
+func WritePreface(w io.Writer, p Preface) error {
+	if len(p.Codecs) > 0xff || len(p.Compressions) > 0xff {
+		return fmt.Errorf("too many codecs or compressions")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 32))
+	buf.Write(PrefaceMagic[:])
+	_ = binary.Write(buf, binary.BigEndian, p.Version)
+	_ = binary.Write(buf, binary.BigEndian, uint16(0))
+	_ = binary.Write(buf, binary.BigEndian, p.MaxFrameSize)
+	_ = binary.Write(buf, binary.BigEndian, uint32(p.HeartbeatInterval/time.Millisecond))
+
+	buf.WriteByte(byte(len(p.Codecs)))
+	for _, c := range p.Codecs {
+		buf.WriteByte(byte(c))
+	}
+
+	buf.WriteByte(byte(len(p.Compressions)))
+	for _, name := range p.Compressions {
+		if len(name) > 0xff {
+			return fmt.Errorf("compression name is too long: %s", name)
+		}
+		buf.WriteByte(byte(len(name)))
+		buf.WriteString(name)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadPreface 读取前导信息，魔数不正确时返回 code.ErrPrefaceMagic。
+func ReadPreface(r io.Reader) (Preface, error) {
+	var (
+		p    Preface
+		head [16]byte
+	)
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return p, err
+	}
+	if !bytes.Equal(head[:4], PrefaceMagic[:]) {
+		return p, fmt.Errorf("%w: %q", code.ErrPrefaceMagic, head[:4])
+	}
+
+	p.Version = binary.BigEndian.Uint16(head[4:6])
+	p.MaxFrameSize = binary.BigEndian.Uint32(head[8:12])
+	p.HeartbeatInterval = time.Duration(binary.BigEndian.Uint32(head[12:16])) * time.Millisecond
+
+	codecs, err := readBytes(r)
+	if err != nil {
+		return p, err
+	}
+	for _, c := range codecs {
+		p.Codecs = append(p.Codecs, codec.MarshalType(c))
+	}
+
+	var num [1]byte
+	if _, err = io.ReadFull(r, num[:]); err != nil {
+		return p, err
+	}
+	for i := 0; i < int(num[0]); i++ {
+		name, err := readBytes(r)
+		if err != nil {
+			return p, err
+		}
+		p.Compressions = append(p.Compressions, string(name))
+	}
+	return p, nil
+}
+
+// readBytes 读取一个字节长度前缀的数据
+func readBytes(r io.Reader) ([]byte, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size[0])
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Negotiate 根据本端和对端的前导信息协商连接参数。
+// 对端版本过低或者没有共同的序列化类型时返回错误。
+func Negotiate(local, peer Preface) (Negotiated, error) {
+	var n Negotiated
+
+	n.Version = local.Version
+	if peer.Version < n.Version {
+		n.Version = peer.Version
+	}
+	if n.Version < MinProtoVersion {
+		return n, fmt.Errorf("%w: local %d, peer %d, min %d",
+			code.ErrVersionMismatch, local.Version, peer.Version, MinProtoVersion)
+	}
+
+	for _, c := range local.Codecs {
+		for _, pc := range peer.Codecs {
+			if c == pc {
+				n.Codecs = append(n.Codecs, c)
+				break
+			}
+		}
+	}
+	if len(n.Codecs) == 0 {
+		return n, fmt.Errorf("%w: local %q, peer %q", code.ErrNoCommonCodec, local.Codecs, peer.Codecs)
+	}
+
+	// 以本端的优先级为准，双方使用相同的算法列表时结果一致
+	for _, c := range local.Compressions {
+		for _, pc := range peer.Compressions {
+			if c == pc {
+				n.Compression = c
+				break
+			}
+		}
+		if n.Compression != "" {
+			break
+		}
+	}
+
+	n.MaxFrameSize = local.MaxFrameSize
+	if peer.MaxFrameSize < n.MaxFrameSize {
+		n.MaxFrameSize = peer.MaxFrameSize
+	}
+
+	n.HeartbeatInterval = local.HeartbeatInterval
+	if peer.HeartbeatInterval > n.HeartbeatInterval {
+		n.HeartbeatInterval = peer.HeartbeatInterval
+	}
+	return n, nil
+}
@@ -0,0 +1,80 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/codec"
+)
+
+func TestPreface_RoundTrip(t *testing.T) {
+	p := Preface{
+		Version:           ProtoVersion,
+		Codecs:            []codec.MarshalType{codec.MarshalType_Json, codec.MarshalType_Proto},
+		Compressions:      []string{"gzip", "zstd"},
+		MaxFrameSize:      1024,
+		HeartbeatInterval: 5 * time.Second,
+	}
+
+	var buf bytes.Buffer
+	if err := WritePreface(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPreface(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, got) {
+		t.Fatalf("want %+v, got %+v", p, got)
+	}
+
+	_, err = ReadPreface(bytes.NewReader(make([]byte, 32)))
+	if !errors.Is(err, code.ErrPrefaceMagic) {
+		t.Fatalf("want ErrPrefaceMagic, got %v", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	local := Preface{
+		Version:      ProtoVersion,
+		Codecs:       []codec.MarshalType{codec.MarshalType_Json, codec.MarshalType_Proto},
+		Compressions: []string{"zstd", "gzip"},
+		MaxFrameSize: 1024,
+	}
+	peer := Preface{
+		Version:           ProtoVersion,
+		Codecs:            []codec.MarshalType{codec.MarshalType_Proto},
+		Compressions:      []string{"gzip", "zstd"},
+		MaxFrameSize:      512,
+		HeartbeatInterval: time.Second,
+	}
+
+	n, err := Negotiate(local, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Negotiated{
+		Version:           ProtoVersion,
+		Codecs:            []codec.MarshalType{codec.MarshalType_Proto},
+		Compression:       "zstd",
+		MaxFrameSize:      512,
+		HeartbeatInterval: time.Second,
+	}
+	if !reflect.DeepEqual(n, want) {
+		t.Fatalf("want %+v, got %+v", want, n)
+	}
+
+	peer.Codecs = []codec.MarshalType{codec.MarshalType_Raw}
+	if _, err = Negotiate(local, peer); !errors.Is(err, code.ErrNoCommonCodec) {
+		t.Fatalf("want ErrNoCommonCodec, got %v", err)
+	}
+
+	peer.Version = 0
+	if _, err = Negotiate(local, peer); !errors.Is(err, code.ErrVersionMismatch) {
+		t.Fatalf("want ErrVersionMismatch, got %v", err)
+	}
+}
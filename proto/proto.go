@@ -1,6 +1,8 @@
 package proto
 
 import (
+	"io"
+
 	"github.com/ywanbing/spider/message"
 )
 
@@ -10,3 +12,40 @@ type Proto interface {
 	// Unpack reads bytes from the connection to the Message.
 	Unpack([]byte) (message.Message, error)
 }
+
+// PoolPacker 可以由 Proto 实现，使用 alloc 分配打包后的数据，
+// 以便发送完成后归还到对象池，减少内存分配。
+type PoolPacker interface {
+	// PackWith 和 Pack 相同，但是使用 alloc 分配返回的数据。
+	PackWith(m message.Message, alloc func(size int) []byte) ([]byte, error)
+}
+
+// LanePacker 可以由 Proto 实现，打包的结果依赖打包顺序时（例如加密的计数器），按照 lane 分别打包。
+// 发送队列按照优先级重新排序帧，每个队列使用一个 lane，同一个 lane 内的帧按照打包的顺序发送。
+type LanePacker interface {
+	// PackLaneWith 和 PoolPacker.PackWith 相同，lane 为帧所在的发送队列
+	PackLaneWith(m message.Message, lane uint8, alloc func(size int) []byte) ([]byte, error)
+}
+
+// Handshaker 可以由 Proto 实现，在连接前导协商完成后调用，返回该连接专用的 Proto。
+// 调用时连接还没有开始收发消息，可以通过 rw 直接和对端交换数据。
+type Handshaker interface {
+	Handshake(rw io.ReadWriter, n Negotiated) (Proto, error)
+}
+
+// Compressible 可以由 Proto 实现，返回在连接前导中声明支持的压缩算法，按优先级排序。
+type Compressible interface {
+	Compressions() []string
+}
+
+// packLane 按照 p 支持的方式打包，依次尝试 LanePacker、PoolPacker 和 Pack。
+// 包装其他 Proto 的实现需要使用它打包，才能把 lane 传递给 base。
+func packLane(p Proto, m message.Message, lane uint8, alloc func(size int) []byte) ([]byte, error) {
+	if lp, ok := p.(LanePacker); ok {
+		return lp.PackLaneWith(m, lane, alloc)
+	}
+	if pp, ok := p.(PoolPacker); ok {
+		return pp.PackWith(m, alloc)
+	}
+	return p.Pack(m)
+}
@@ -0,0 +1,82 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/codec"
+	"github.com/ywanbing/spider/message"
+)
+
+// fuzzSeeds 返回合法的和被截断的帧，作为 fuzz 的种子语料
+func fuzzSeeds(p Proto) [][]byte {
+	msgs := []message.Message{
+		message.NewMessage(1, codec.MarshalType_Raw, map[string]string{
+			message.MsgTypeKey: message.MsgTypeRequest.String(),
+			message.MsgSeq:     "1",
+		}, []byte("hello world")),
+		message.NewMessage(0x10001, codec.MarshalType_Json, map[string]string{}, []byte(`{"a":1}`)),
+		message.NewMessage(2, codec.MarshalType_Proto, nil, []byte{0}),
+		// 超过压缩阈值的消息体
+		message.NewMessage(3, codec.MarshalType_Raw, map[string]string{
+			message.MsgTypeKey: message.MsgTypePush.String(),
+		}, bytes.Repeat([]byte("spider"), 512)),
+	}
+
+	seeds := [][]byte{nil, {0}, make([]byte, 12), {0, 0, 0, 1, 'R', 0, 0x0f, 0xff}}
+	for _, m := range msgs {
+		data, err := p.Pack(m)
+		if err != nil {
+			continue
+		}
+		seeds = append(seeds, data, data[:len(data)/2], data[:len(data)-1])
+	}
+	return seeds
+}
+
+func fuzzUnpack(f *testing.F, p Proto) {
+	for _, seed := range fuzzSeeds(p) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := p.Unpack(data)
+		if err != nil {
+			if !errors.Is(err, code.ErrMalformedFrame) {
+				t.Fatalf("unexpected error type: %v", err)
+			}
+			return
+		}
+		if m == nil || m.GetHeader() == nil {
+			t.Fatal("nil message or header without error")
+		}
+
+		// 能够解析的消息，重新打包后需要得到相同的消息
+		packed, err := p.Pack(m)
+		if err != nil {
+			return
+		}
+		m2, err := p.Unpack(packed)
+		if err != nil {
+			t.Fatalf("unpack repacked message: %v", err)
+		}
+		if m.GetMsgId() != m2.GetMsgId() || m.GetMarshalType() != m2.GetMarshalType() ||
+			!bytes.Equal(m.GetBody(), m2.GetBody()) {
+			t.Fatal("repacked message mismatch")
+		}
+	})
+}
+
+func FuzzRawProto_Unpack(f *testing.F) {
+	fuzzUnpack(f, NewRawProto())
+}
+
+func FuzzBinaryHeaderProto_Unpack(f *testing.F) {
+	fuzzUnpack(f, NewBinaryHeaderProto())
+}
+
+func FuzzGzipProto_Unpack(f *testing.F) {
+	fuzzUnpack(f, NewGzipProto())
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/ywanbing/spider/code"
 	"github.com/ywanbing/spider/codec"
 	"github.com/ywanbing/spider/message"
 )
@@ -17,68 +18,145 @@ const (
 	MetadataSize = 3
 
 	BodySize = 4
-	AllSize  = MsgSize + MsgIDSize + MetadataSize + ProtoSize + BodySize
+	// HeaderSize 负载的最小长度，不包括 Framer 的长度字段
+	HeaderSize = MsgIDSize + MetadataSize + ProtoSize + BodySize
+	// AllSize 使用默认 Framer 时帧的最小长度
+	AllSize = MsgSize + HeaderSize
+
+	// 元数据的最大长度，占用头部长度字段的低 12 位
+	maxMetadataLen = 0x0fff
+	// 帧标志位占用头部长度字段的高 12 位
+	flagShift = 12
+	flagMask  = 0x0fff
 )
 
-// RawProto 提供默认的Proto实现
-type RawProto struct{}
+// 帧标志位
+const (
+	// FlagBinaryHeader 元数据使用二进制编码，而不是 json
+	FlagBinaryHeader uint16 = 1 << iota
+	// FlagCompressed 消息体已经被压缩，第一个字节为压缩算法的 ID
+	FlagCompressed
+	// FlagEncrypted 消息体已经被加密
+	FlagEncrypted
+	// FlagChecksum 消息体末尾带有 CRC32C 校验和
+	FlagChecksum
+)
 
-// NewRawProto 创建一个 RawProto, 并且初始化缓存池
+// RawProto 提供默认的Proto实现，只处理帧的负载，帧的划分由 Framer 负责。
+// 负载格式：[msgId = 4][protoType = 1b, flags = 12bit, meatDataLen = 12bit][meatData][bodyLen = 4][body]
+type RawProto struct {
+	// 元数据是否使用二进制编码
+	binaryHeader bool
+}
+
+// NewRawProto 创建一个 RawProto, 元数据使用 json 序列化
 func NewRawProto() *RawProto {
 	return &RawProto{}
 }
 
+// NewBinaryHeaderProto 创建一个元数据使用二进制编码的 RawProto，
+// 常用的 key（msg_type, msg_seq, msg_err）只占用 1 个字节。
+// 解析时根据帧标志位自动识别，可以和 NewRawProto 互通。
+func NewBinaryHeaderProto() *RawProto {
+	return &RawProto{binaryHeader: true}
+}
+
 func (r RawProto) Pack(m message.Message) ([]byte, error) {
-	// 元数据默认为 json 序列化
-	meatData, _ := json.Marshal(m.GetHeader())
-	meatDataLen := len(meatData)
-	if meatDataLen > 0x0fff {
+	return r.PackWith(m, nil)
+}
+
+// PackWith 使用 alloc 分配打包后的数据，alloc 为 nil 时直接分配。
+func (r RawProto) PackWith(m message.Message, alloc func(size int) []byte) ([]byte, error) {
+	var (
+		flags       = m.GetFlags() &^ FlagBinaryHeader & flagMask
+		meatData    []byte
+		meatDataLen int
+	)
+	if r.binaryHeader {
+		flags |= FlagBinaryHeader
+		meatDataLen = binaryHeaderSize(m.GetHeader())
+	} else {
+		// 元数据默认为 json 序列化
+		meatData, _ = json.Marshal(m.GetHeader())
+		meatDataLen = len(meatData)
+	}
+	if meatDataLen > maxMetadataLen {
 		return nil, fmt.Errorf("metadata is too long")
 	}
 
 	body := m.GetBody()
 	bodyLen := len(body)
 
-	allSize := AllSize + meatDataLen + bodyLen
-	data := make([]byte, allSize)
-
-	// 1. 写入消息长度
-	binary.BigEndian.PutUint32(data[:4], uint32(allSize))
-	// 2. 写入消息id
-	binary.BigEndian.PutUint32(data[4:8], m.GetMsgId())
-	// 3. 写入序列化类型和头部长度[protoType = 1b, meatDataLen = 3b]
-	binary.BigEndian.PutUint32(data[8:12], uint32(m.GetMarshalType())<<24|uint32(meatDataLen))
-	// 4. 写入元数据
-	copy(data[12:12+meatDataLen], meatData)
-	// 5. 写入消息体长度
-	binary.BigEndian.PutUint32(data[12+meatDataLen:16+meatDataLen], uint32(bodyLen))
-	// 6. 写入消息体
-	copy(data[16+meatDataLen:], body)
+	allSize := HeaderSize + meatDataLen + bodyLen
+	var data []byte
+	if alloc != nil {
+		data = alloc(allSize)
+	} else {
+		data = make([]byte, allSize)
+	}
+
+	// 1. 写入消息id
+	binary.BigEndian.PutUint32(data[:4], m.GetMsgId())
+	// 2. 写入序列化类型和头部长度[protoType = 1b, flags = 12bit, meatDataLen = 12bit]
+	binary.BigEndian.PutUint32(data[4:8], uint32(m.GetMarshalType())<<24|uint32(flags)<<flagShift|uint32(meatDataLen))
+	// 3. 写入元数据
+	if r.binaryHeader {
+		putBinaryHeader(data[8:8+meatDataLen], m.GetHeader())
+	} else {
+		copy(data[8:8+meatDataLen], meatData)
+	}
+	// 4. 写入消息体长度
+	binary.BigEndian.PutUint32(data[8+meatDataLen:12+meatDataLen], uint32(bodyLen))
+	// 5. 写入消息体
+	copy(data[12+meatDataLen:], body)
 
 	return data, nil
 }
 
+// Unpack 解析帧的负载，数据不合法时返回 code.ErrMalformedFrame。
 func (r RawProto) Unpack(data []byte) (message.Message, error) {
+	// 消息id + 序列化类型和头部长度 + 消息体长度
+	const minSize = HeaderSize
+	if len(data) < minSize {
+		return nil, fmt.Errorf("%w: frame size %d < %d", code.ErrMalformedFrame, len(data), minSize)
+	}
+
 	msgId := binary.BigEndian.Uint32(data[:4])
 	protoTypeAndMeatSize := binary.BigEndian.Uint32(data[4:8])
 	protoType := codec.MarshalType(protoTypeAndMeatSize >> 24)
-	meatDataLen := protoTypeAndMeatSize & 0x0fff
+	flags := uint16((protoTypeAndMeatSize >> flagShift) & flagMask)
+	meatDataLen := int(protoTypeAndMeatSize & maxMetadataLen)
+	if len(data) < minSize+meatDataLen {
+		return nil, fmt.Errorf("%w: metadata size %d exceeds frame size %d", code.ErrMalformedFrame, meatDataLen, len(data))
+	}
 	meatData := data[8 : 8+meatDataLen]
-	bodyDataLen := binary.BigEndian.Uint32(data[8+meatDataLen : 12+meatDataLen])
+	bodyDataLen := int(binary.BigEndian.Uint32(data[8+meatDataLen : 12+meatDataLen]))
+	if bodyDataLen != len(data)-minSize-meatDataLen {
+		return nil, fmt.Errorf("%w: body size %d does not match frame size %d", code.ErrMalformedFrame, bodyDataLen, len(data))
+	}
 
 	// 结束引用
 	bodyData := make([]byte, bodyDataLen)
 	copy(bodyData, data[12+meatDataLen:])
 
 	// 1. 解析元数据
-	meat := make(map[string]string)
-	if meatDataLen > 0 {
+	var meat map[string]string
+	if flags&FlagBinaryHeader != 0 {
+		var err error
+		if meat, err = parseBinaryHeader(meatData); err != nil {
+			return nil, err
+		}
+	} else if meatDataLen > 0 {
 		err := json.Unmarshal(meatData, &meat)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: metadata: %v", code.ErrMalformedFrame, err)
 		}
 	}
+	if meat == nil {
+		meat = make(map[string]string)
+	}
 
 	m := message.NewMessage(msgId, protoType, meat, bodyData)
+	m.SetFlags(flags)
 	return m, nil
 }
@@ -0,0 +1,92 @@
+package proto
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ywanbing/spider/common"
+	"github.com/ywanbing/spider/message"
+)
+
+// BenchmarkRawProto_Pack 对比直接分配和使用缓存池分配发送帧的内存开销
+func BenchmarkRawProto_Pack(b *testing.B) {
+	m := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypePush.String(),
+	}, make([]byte, 1024))
+	p := NewRawProto()
+
+	b.Run("make", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = p.Pack(m)
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		pool := common.NewLimitedPool(512, 512*1024)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, _ := p.PackWith(m, pool.Get)
+			common.NewFrame(data, pool).Release()
+		}
+	})
+}
+
+func TestRawProto_BinaryHeader(t *testing.T) {
+	m := message.NewMessage(1, 'J', map[string]string{
+		message.MsgTypeKey: message.MsgTypeRequest.String(),
+		message.MsgSeq:     "12",
+		message.MsgErr:     "",
+		"custom":           "value",
+	}, []byte("hello"))
+
+	protos := []Proto{NewRawProto(), NewBinaryHeaderProto()}
+	for _, packer := range protos {
+		data, err := packer.Pack(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 两种编码可以互相解析
+		for _, unpacker := range protos {
+			got, err := unpacker.Unpack(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.GetMsgId() != m.GetMsgId() || got.GetMarshalType() != m.GetMarshalType() ||
+				string(got.GetBody()) != string(m.GetBody()) || !reflect.DeepEqual(got.GetHeader(), m.GetHeader()) {
+				t.Fatalf("want %+v, got %+v", m, got)
+			}
+		}
+	}
+}
+
+// BenchmarkRawProto_Header 对比 json 和二进制编码元数据的开销
+func BenchmarkRawProto_Header(b *testing.B) {
+	m := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypeRequest.String(),
+		message.MsgSeq:     "123456",
+	}, make([]byte, 128))
+
+	protos := map[string]*RawProto{
+		"json":   NewRawProto(),
+		"binary": NewBinaryHeaderProto(),
+	}
+	for name, p := range protos {
+		p := p
+		data, _ := p.Pack(m)
+
+		b.Run("pack-"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = p.Pack(m)
+			}
+		})
+		b.Run("unpack-"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = p.Unpack(data)
+			}
+		})
+	}
+}
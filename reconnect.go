@@ -0,0 +1,73 @@
+package spider
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy 客户端断线重连的策略
+type ReconnectPolicy interface {
+	// Next 返回第 attempt 次（从 1 开始）重连前需要等待的时间，
+	// elapsed 为从断线开始经过的时间，返回 false 时放弃重连。
+	Next(attempt int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// BackoffPolicy 指数退避的重连策略，等待时间在 [0, min(Max, Initial*Multiplier^(attempt-1))) 中随机选取（full jitter）。
+type BackoffPolicy struct {
+	// 第一次重连的最长等待时间
+	Initial time.Duration
+	// 等待时间的上限，0 表示不限制
+	Max time.Duration
+	// 每次重连后等待时间的倍数，小于 1 时视为 1
+	Multiplier float64
+	// 是否随机选取等待时间，为 false 时使用最长等待时间
+	Jitter bool
+
+	// 最多重连次数，0 表示不限制
+	MaxAttempts int
+	// 从断线开始最多重连多久，0 表示不限制
+	MaxElapsed time.Duration
+}
+
+// NewBackoffPolicy 创建默认的重连策略：10ms 开始翻倍，最长 5s，随机等待，最多重连 10 次。
+func NewBackoffPolicy() *BackoffPolicy {
+	return &BackoffPolicy{
+		Initial:     10 * time.Millisecond,
+		Max:         5 * time.Second,
+		Multiplier:  2,
+		Jitter:      true,
+		MaxAttempts: 10,
+	}
+}
+
+func (p *BackoffPolicy) Next(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if p.MaxAttempts > 0 && attempt > p.MaxAttempts {
+		return 0, false
+	}
+	if p.MaxElapsed > 0 && elapsed >= p.MaxElapsed {
+		return 0, false
+	}
+
+	limit := float64(p.Max)
+	if p.Max <= 0 {
+		limit = math.MaxInt64 / 2
+	}
+	delay := float64(p.Initial)
+	for i := 1; i < attempt && p.Multiplier > 1 && delay < limit; i++ {
+		delay *= p.Multiplier
+	}
+	if delay > limit {
+		delay = limit
+	}
+	// 不超过剩余的时间
+	if p.MaxElapsed > 0 && delay > float64(p.MaxElapsed-elapsed) {
+		delay = float64(p.MaxElapsed - elapsed)
+	}
+
+	d := time.Duration(delay)
+	if p.Jitter && d > 0 {
+		d = time.Duration(rand.Int63n(int64(d)))
+	}
+	return d, true
+}
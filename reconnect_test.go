@@ -0,0 +1,251 @@
+package spider
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/common"
+	"github.com/ywanbing/spider/message"
+)
+
+func TestBackoffPolicy(t *testing.T) {
+	p := &BackoffPolicy{
+		Initial:     10 * time.Millisecond,
+		Max:         50 * time.Millisecond,
+		Multiplier:  2,
+		MaxAttempts: 5,
+	}
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if d, ok := p.Next(attempt+1, 0); !ok || d != want*time.Millisecond {
+			t.Fatalf("attempt %d: want %v, got %v %v", attempt+1, want*time.Millisecond, d, ok)
+		}
+	}
+	if _, ok := p.Next(6, 0); ok {
+		t.Fatal("should give up after max attempts")
+	}
+
+	p.Jitter = true
+	p.MaxAttempts = 0
+	p.MaxElapsed = time.Second
+	for i := 0; i < 100; i++ {
+		if d, ok := p.Next(10, 990*time.Millisecond); !ok || d < 0 || d >= 10*time.Millisecond {
+			t.Fatalf("jittered delay should be in [0, 10ms), got %v %v", d, ok)
+		}
+	}
+	if _, ok := p.Next(1, time.Second); ok {
+		t.Fatal("should give up after max elapsed time")
+	}
+}
+
+// testListener 接受连接并使用 srv 的路由处理，可以断开所有的连接
+type testListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []TcpConn
+}
+
+func newTestListener(t *testing.T, srv *TcpServer) *testListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &testListener{Listener: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn := NewTcpConn(c.(*net.TCPConn), srv.cfg, srv.handleMessage)
+			conn.Start()
+			l.mu.Lock()
+			l.conns = append(l.conns, conn)
+			l.mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+		l.dropAll()
+	})
+	return l
+}
+
+func (l *testListener) dropAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		_ = conn.Close()
+	}
+	l.conns = nil
+}
+
+func TestTcpClient_Reconnect(t *testing.T) {
+	srv := NewTcpX()
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		_ = ctx.Raw(ctx.GetReqMsgId(), []byte("ok"))
+	})
+	l := newTestListener(t, srv)
+
+	var handled, reconnecting atomic.Int32
+	reconnected := make(chan int, 1)
+	gaveUp := make(chan error, 1)
+	client := NewTcpClient(l.Addr().String(),
+		WithReconnectPolicy(&BackoffPolicy{Initial: time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2, MaxAttempts: 3}),
+		WithOnConnHandle(func(conn TcpConn) bool {
+			handled.Add(1)
+			return true
+		}),
+		WithOnReconnecting(func(attempt int, delay time.Duration) {
+			reconnecting.Add(1)
+		}),
+		WithOnReconnected(func(conn TcpConn, attempt int) {
+			reconnected <- attempt
+		}),
+		WithOnGiveUp(func(err error) {
+			gaveUp <- err
+		}),
+	)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	l.dropAll()
+	select {
+	case attempt := <-reconnected:
+		if attempt != 1 {
+			t.Fatalf("want reconnected at attempt 1, got %d", attempt)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("client should reconnect")
+	}
+	if handled.Load() != 2 {
+		t.Fatalf("onConnHandle should run on every connection, got %d", handled.Load())
+	}
+	if _, err := client.Call(context.Background(), message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务端关闭后放弃重连
+	_ = l.Close()
+	l.dropAll()
+	select {
+	case err := <-gaveUp:
+		if err == nil {
+			t.Fatal("give up should report the last error")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("client should give up")
+	}
+	if reconnecting.Load() != 4 {
+		t.Fatalf("want 4 reconnect attempts, got %d", reconnecting.Load())
+	}
+	select {
+	case <-client.close:
+	case <-time.After(time.Second):
+		t.Fatal("client should be closed after giving up")
+	}
+}
+
+// waitForState 等待客户端进入 want 状态
+func waitForState(t *testing.T, client *TcpClient, want ConnState) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for state := client.State(); state != want; state = client.State() {
+		if !client.WaitForStateChange(ctx, state) {
+			t.Fatalf("want state %v, got %v", want, state)
+		}
+	}
+}
+
+func TestTcpClient_State(t *testing.T) {
+	blocked := make(chan struct{})
+	srv := NewTcpX()
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		close(blocked)
+		<-ctx.GetCtx().Done()
+	})
+	l := newTestListener(t, srv)
+
+	client := NewTcpClient(l.Addr().String(),
+		WithReconnectPolicy(&BackoffPolicy{Initial: time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2}))
+	if state := client.State(); state != Idle {
+		t.Fatalf("want Idle, got %v", state)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if state := client.State(); state != Ready {
+		t.Fatalf("want Ready, got %v", state)
+	}
+
+	// 连接断开后未完成的调用失败，然后重新连接
+	call := client.Go(context.Background(), message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 1)), nil)
+	<-blocked
+	l.dropAll()
+	select {
+	case <-call.Done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("pending call should fail after disconnect")
+	}
+	if !errors.Is(call.Error, code.ErrConnClosed) {
+		t.Fatalf("want ErrConnClosed, got %v", call.Error)
+	}
+	waitForState(t, client, Ready)
+
+	client.Close()
+	if state := client.State(); state != Shutdown {
+		t.Fatalf("want Shutdown, got %v", state)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if client.WaitForStateChange(ctx, Shutdown) {
+		t.Fatal("state should not change after shutdown")
+	}
+	if _, err := client.Call(context.Background(), message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 1))); !errors.Is(err, code.ErrConnClosed) {
+		t.Fatalf("want ErrConnClosed, got %v", err)
+	}
+	if err := client.Start(); !errors.Is(err, code.ErrConnClosed) {
+		t.Fatalf("want ErrConnClosed, got %v", err)
+	}
+}
+
+func TestTcpClient_StartDuringBackoff(t *testing.T) {
+	srv := NewTcpX()
+	l := newTestListener(t, srv)
+
+	var handled atomic.Int32
+	client := NewTcpClient(l.Addr().String(),
+		WithReconnectPolicy(&BackoffPolicy{Initial: 200 * time.Millisecond, Max: time.Second, Multiplier: 2}),
+		WithOnConnHandle(func(conn TcpConn) bool {
+			handled.Add(1)
+			return true
+		}))
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 重连等待期间调用 Start 不会再建立连接
+	l.dropAll()
+	waitForState(t, client, TransientFailure)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if n := handled.Load(); n != 1 {
+		t.Fatalf("want 1 connection during backoff, got %d", n)
+	}
+
+	waitForState(t, client, Ready)
+	time.Sleep(50 * time.Millisecond)
+	if n := handled.Load(); n != 2 {
+		t.Fatalf("want 2 connections after reconnect, got %d", n)
+	}
+}
@@ -0,0 +1,151 @@
+package spider
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Resolver 服务发现，解析服务的地址列表。
+// 可以基于 etcd、consul 等实现，配合 WithResolver 使用。
+type Resolver interface {
+	// Resolve 返回当前的地址列表
+	Resolve(ctx context.Context) ([]string, error)
+	// Watch 地址列表变化后通过返回的通道推送完整的地址列表，ctx 结束后关闭通道。
+	// 推送的列表可能和之前相同。
+	Watch(ctx context.Context) <-chan []string
+}
+
+// staticResolver 固定的地址列表
+type staticResolver struct {
+	addrs []string
+}
+
+// NewStaticResolver 创建返回固定地址列表的 Resolver
+func NewStaticResolver(addrs ...string) Resolver {
+	return &staticResolver{addrs: normalizeAddrs(addrs)}
+}
+
+func (r *staticResolver) Resolve(ctx context.Context) ([]string, error) {
+	return append([]string(nil), r.addrs...), nil
+}
+
+func (r *staticResolver) Watch(ctx context.Context) <-chan []string {
+	ch := make(chan []string)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+// FileResolver 从文件中读取地址列表，定期检查文件的变化。
+// 文件扩展名为 .yaml 或者 .yml 时按照 YAML 解析，否则按照 JSON 解析。
+// 文件内容可以是地址的数组，或者 addrs 字段为地址数组的对象，例如：
+//
+//	{"addrs": ["127.0.0.1:8000", "127.0.0.1:8001"]}
+type FileResolver struct {
+	path     string
+	interval time.Duration
+}
+
+// NewFileResolver 创建从 path 读取地址列表的 Resolver，interval 为检查文件变化的间隔，默认 1s。
+func NewFileResolver(path string, interval time.Duration) *FileResolver {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &FileResolver{path: path, interval: interval}
+}
+
+func (r *FileResolver) Resolve(ctx context.Context) ([]string, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	unmarshal := json.Unmarshal
+	switch filepath.Ext(r.path) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	}
+
+	var addrs []string
+	if err = unmarshal(data, &addrs); err != nil {
+		var file struct {
+			Addrs []string `json:"addrs" yaml:"addrs"`
+		}
+		if unmarshal(data, &file) != nil {
+			return nil, err
+		}
+		addrs = file.Addrs
+	}
+	return normalizeAddrs(addrs), nil
+}
+
+func (r *FileResolver) Watch(ctx context.Context) <-chan []string {
+	ch := make(chan []string, 1)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		var last []string
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			addrs, err := r.Resolve(ctx)
+			if err != nil || equalAddrs(addrs, last) {
+				// TODO log 文件可能正在写入
+				continue
+			}
+			last = addrs
+			select {
+			case ch <- addrs:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// normalizeAddrs 排序并去掉重复和空的地址
+func normalizeAddrs(addrs []string) []string {
+	res := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr != "" {
+			res = append(res, addr)
+		}
+	}
+	sort.Strings(res)
+
+	n := 0
+	for i, addr := range res {
+		if i == 0 || addr != res[n-1] {
+			res[n] = addr
+			n++
+		}
+	}
+	return res[:n]
+}
+
+func equalAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package spider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileResolver(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"addrs.json": `["b:2", "a:1", "b:2"]`,
+		"addrs.yaml": "addrs:\n  - b:2\n  - a:1\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		addrs, err := NewFileResolver(path, 0).Resolve(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalAddrs(addrs, []string{"a:1", "b:2"}) {
+			t.Fatalf("%s: unexpected addrs %v", name, addrs)
+		}
+	}
+
+	path := filepath.Join(dir, "watch.json")
+	if err := os.WriteFile(path, []byte(`{"addrs": ["a:1"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := NewFileResolver(path, 5*time.Millisecond).Watch(ctx)
+	for _, want := range [][]string{{"a:1"}, {"a:1", "c:3"}} {
+		select {
+		case addrs := <-updates:
+			if !equalAddrs(addrs, want) {
+				t.Fatalf("want %v, got %v", want, addrs)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("want update %v", want)
+		}
+		if err := os.WriteFile(path, []byte(`{"addrs": ["c:3", "a:1"]}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+	for range updates {
+	}
+}
+
+// chanResolver 通过通道推送地址列表，模拟 etcd 等外部的服务发现
+type chanResolver struct {
+	addrs   []string
+	updates chan []string
+}
+
+func (r *chanResolver) Resolve(ctx context.Context) ([]string, error) {
+	return r.addrs, nil
+}
+
+func (r *chanResolver) Watch(ctx context.Context) <-chan []string {
+	return r.updates
+}
+
+func TestClientPool_Resolver(t *testing.T) {
+	a := newTestPoolServer(t, "a")
+	b := newTestPoolServer(t, "b")
+	r := &chanResolver{addrs: []string{a.Addr().String()}, updates: make(chan []string)}
+	defer close(r.updates)
+
+	pool := NewClientPool(nil, WithPoolSize(2), WithResolver(r))
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if got := testPoolCall(t, pool, ""); got != "a" {
+		t.Fatalf("want a, got %s", got)
+	}
+
+	r.updates <- []string{b.Addr().String()}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		pool.mu.RLock()
+		addrs := append([]string(nil), pool.addrs...)
+		pool.mu.RUnlock()
+		if equalAddrs(addrs, []string{b.Addr().String()}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool should reconcile to the new address, got %v", addrs)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		if got := testPoolCall(t, pool, ""); got != "b" {
+			t.Fatalf("want b, got %s", got)
+		}
+	}
+}
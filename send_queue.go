@@ -0,0 +1,212 @@
+package spider
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ywanbing/spider/common"
+	"github.com/ywanbing/spider/message"
+)
+
+// 发送队列的优先级数量
+const priorityLevels = int(message.PriorityHigh-message.PriorityLow) + 1
+
+// sendQueue 多级发送队列，优先发送高优先级的帧，同一个优先级内按照入队的顺序发送。
+// 为了避免低优先级的帧一直得不到发送，某个优先级被连续跳过 starvation 次后，优先发送一次。
+// 入队可以并发调用，出队只在发送协程中调用。
+type sendQueue struct {
+	mu sync.Mutex
+	// 按照优先级从高到低排列，每个优先级最多 size 个帧
+	levels [priorityLevels][]*common.Frame
+	size   int
+	// 有新的帧时通知发送协程
+	ready chan struct{}
+	// 有入队在等待时创建，出队后关闭
+	space chan struct{}
+
+	// 每个优先级被连续跳过的次数
+	skipped    [priorityLevels]int
+	starvation int
+}
+
+func newSendQueue(size int32, starvation int) *sendQueue {
+	return &sendQueue{
+		size:       int(size),
+		ready:      make(chan struct{}, 1),
+		starvation: starvation,
+	}
+}
+
+// levelOf 返回优先级对应的队列下标，同时作为 proto.LanePacker 的 lane
+func levelOf(p message.Priority) int {
+	level := int(message.PriorityHigh) - int(p)
+	if level < 0 {
+		level = 0
+	} else if level >= priorityLevels {
+		level = priorityLevels - 1
+	}
+	return level
+}
+
+// levelOfFrame 返回帧所在的队列下标
+func levelOfFrame(f *common.Frame) int {
+	return levelOf(message.Priority(f.Priority()))
+}
+
+// push 放入一个帧，队列满时返回 false
+func (q *sendQueue) push(f *common.Frame) bool {
+	return q.pushOrWait(f) == nil
+}
+
+// pushOrWait 放入一个帧，队列满时返回有空闲位置后关闭的通道
+func (q *sendQueue) pushOrWait(f *common.Frame) <-chan struct{} {
+	level := levelOfFrame(f)
+
+	q.mu.Lock()
+	if len(q.levels[level]) >= q.size {
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+		q.mu.Unlock()
+		return space
+	}
+	q.levels[level] = append(q.levels[level], f)
+	q.mu.Unlock()
+
+	q.notify()
+	return nil
+}
+
+// waitSpace 优先级 level 有空闲位置时返回 nil，否则返回有空闲位置后关闭的通道
+func (q *sendQueue) waitSpace(level int) <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.levels[level]) < q.size {
+		return nil
+	}
+	if q.space == nil {
+		q.space = make(chan struct{})
+	}
+	return q.space
+}
+
+// pushDropOldest 放入一个帧，队列满时丢弃同一优先级中最早的帧并返回。
+// 分片不会被单独丢弃：跳过队列中的分片，放入的帧本身是分片或者队列中全部是分片时返回 false。
+func (q *sendQueue) pushDropOldest(f *common.Frame) (*common.Frame, bool) {
+	level := levelOfFrame(f)
+
+	q.mu.Lock()
+	var dropped *common.Frame
+	frames := q.levels[level]
+	if len(frames) >= q.size {
+		if f.Fragment() {
+			q.mu.Unlock()
+			return nil, false
+		}
+		for i, old := range frames {
+			if !old.Fragment() {
+				dropped = old
+				copy(frames[i:], frames[i+1:])
+				frames[len(frames)-1] = nil
+				frames = frames[:len(frames)-1]
+				break
+			}
+		}
+		if dropped == nil {
+			q.mu.Unlock()
+			return nil, false
+		}
+	}
+	q.levels[level] = append(frames, f)
+	q.mu.Unlock()
+
+	q.notify()
+	return dropped, true
+}
+
+// notify 通知发送协程有新的帧
+func (q *sendQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// len 返回所有队列中帧的数量
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, frames := range q.levels {
+		n += len(frames)
+	}
+	return n
+}
+
+// pop 取出某个优先级最早的帧，需要持有锁
+func (q *sendQueue) pop(level int) *common.Frame {
+	frames := q.levels[level]
+	if len(frames) == 0 {
+		return nil
+	}
+	f := frames[0]
+	frames[0] = nil
+	q.levels[level] = frames[1:]
+
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+	return f
+}
+
+// tryDequeue 按照优先级取出一个帧，队列为空时返回 nil
+func (q *sendQueue) tryDequeue() *common.Frame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// 先发送等待太久的低优先级
+	if q.starvation > 0 {
+		for level := priorityLevels - 1; level > 0; level-- {
+			if q.skipped[level] < q.starvation {
+				continue
+			}
+			q.skipped[level] = 0
+			if f := q.pop(level); f != nil {
+				return f
+			}
+		}
+	}
+
+	for level := range q.levels {
+		if f := q.pop(level); f != nil {
+			q.skipped[level] = 0
+			for lower := level + 1; lower < priorityLevels; lower++ {
+				if len(q.levels[lower]) > 0 {
+					q.skipped[lower]++
+				}
+			}
+			return f
+		}
+	}
+	return nil
+}
+
+// dequeue 按照优先级取出一个帧，队列为空时阻塞直到有新的帧、done 被关闭或者 timeout 到期，
+// 后两种情况返回 nil。timeout 为 nil 时不会超时。
+func (q *sendQueue) dequeue(done <-chan struct{}, timeout <-chan time.Time) *common.Frame {
+	for {
+		if f := q.tryDequeue(); f != nil {
+			return f
+		}
+
+		select {
+		case <-q.ready:
+		case <-done:
+			return nil
+		case <-timeout:
+			return nil
+		}
+	}
+}
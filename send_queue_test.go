@@ -0,0 +1,78 @@
+package spider
+
+import (
+	"testing"
+
+	"github.com/ywanbing/spider/common"
+	"github.com/ywanbing/spider/message"
+)
+
+func newTestFrame(p message.Priority) *common.Frame {
+	f := common.NewFrame([]byte{byte(p)}, nil)
+	f.SetPriority(int8(p))
+	return f
+}
+
+func TestSendQueue(t *testing.T) {
+	t.Run("priority", func(t *testing.T) {
+		q := newSendQueue(10, 0)
+		for _, p := range []message.Priority{message.PriorityLow, message.PriorityNormal, message.PriorityHigh} {
+			q.push(newTestFrame(p))
+		}
+		for _, want := range []message.Priority{message.PriorityHigh, message.PriorityNormal, message.PriorityLow} {
+			if f := q.tryDequeue(); f == nil || message.Priority(f.Priority()) != want {
+				t.Fatalf("want %v, got %v", want, f)
+			}
+		}
+		if q.tryDequeue() != nil {
+			t.Fatal("queue should be empty")
+		}
+	})
+
+	t.Run("drop-oldest", func(t *testing.T) {
+		q := newSendQueue(3, 0)
+		fragment := func(b byte) *common.Frame {
+			f := common.NewFrame([]byte{b}, nil)
+			f.SetFragment(true)
+			return f
+		}
+		q.push(fragment(1))
+		q.push(common.NewFrame([]byte{2}, nil))
+		q.push(fragment(3))
+
+		// 跳过分片，丢弃最早的普通帧
+		if old, ok := q.pushDropOldest(common.NewFrame([]byte{4}, nil)); !ok || old.Bytes()[0] != 2 {
+			t.Fatalf("want frame 2 dropped, got %v, %v", old, ok)
+		}
+		if _, ok := q.pushDropOldest(fragment(5)); ok {
+			t.Fatal("fragment should not replace other frames")
+		}
+		// 按照入队的顺序发送
+		for _, want := range []byte{1, 3, 4} {
+			if f := q.tryDequeue(); f == nil || f.Bytes()[0] != want {
+				t.Fatalf("want %d, got %v", want, f)
+			}
+		}
+	})
+
+	t.Run("starvation", func(t *testing.T) {
+		q := newSendQueue(10, 2)
+		q.push(newTestFrame(message.PriorityLow))
+		for i := 0; i < 5; i++ {
+			q.push(newTestFrame(message.PriorityHigh))
+		}
+
+		var got []message.Priority
+		for f := q.tryDequeue(); f != nil; f = q.tryDequeue() {
+			got = append(got, message.Priority(f.Priority()))
+		}
+		// 低优先级被跳过 2 次后优先发送
+		want := []message.Priority{message.PriorityHigh, message.PriorityHigh, message.PriorityLow,
+			message.PriorityHigh, message.PriorityHigh, message.PriorityHigh}
+		for i := range want {
+			if i >= len(got) || got[i] != want[i] {
+				t.Fatalf("want %v, got %v", want, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,441 @@
+package spider
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+)
+
+// 流消息的操作类型，保存在消息头 message.MsgStreamOp 中
+const (
+	// streamOpOpen 发起方建立流，MsgStreamCredit 为发起方的接收窗口
+	streamOpOpen = "open"
+	// streamOpData 数据消息
+	streamOpData = "data"
+	// streamOpEnd 发送方结束发送（半关闭）
+	streamOpEnd = "end"
+	// streamOpClose 接收方的处理函数已经返回，流结束，MsgErr 不为空时表示错误
+	streamOpClose = "close"
+	// streamOpCancel 发起方取消流
+	streamOpCancel = "cancel"
+	// streamOpCredit 增加对端的发送额度
+	streamOpCredit = "credit"
+)
+
+// StreamHandler 流的处理函数，返回后流结束，返回的错误会发送给发起方。
+type StreamHandler func(ctx *Context, s *Stream) error
+
+// Stream 由客户端发起的双向消息流，使用 message.MsgStreamId 区分。
+// 每个方向按照消息数量进行流控，接收方消费一半的窗口后归还额度。
+// Send 和 Recv 可以在不同的协程中调用，但是不能并发调用同一个方法。
+type Stream struct {
+	conn  *tcpConn
+	id    uint64
+	msgId uint32
+	// 是否由本端发起
+	initiator bool
+	// 本端接收窗口的大小
+	window int
+
+	// 流结束后取消
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// 接收队列，对端结束发送后关闭 recvDone，recvErr 为 Recv 最后返回的错误
+	recv     chan message.Message
+	recvOnce sync.Once
+	recvDone chan struct{}
+	recvErr  error
+	// 已经消费但是还没有归还给对端的额度，只在 Recv 中使用
+	consumed int
+
+	mu sync.Mutex
+	// 本端的发送额度
+	credits  int
+	creditCh chan struct{}
+	// 不为 nil 时不能再发送
+	sendErr error
+	// 流已经结束
+	done bool
+}
+
+func newStream(ctx context.Context, conn *tcpConn, id uint64, msgId uint32, initiator bool) *Stream {
+	s := &Stream{
+		conn:      conn,
+		id:        id,
+		msgId:     msgId,
+		initiator: initiator,
+		window:    conn.cfg.streamWindow,
+		recv:      make(chan message.Message, conn.cfg.streamWindow),
+		recvDone:  make(chan struct{}),
+		creditCh:  make(chan struct{}, 1),
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	return s
+}
+
+// Id 返回流的 id
+func (s *Stream) Id() uint64 {
+	return s.id
+}
+
+// Context 返回流的上下文，流结束后被取消
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Send 发送一个消息，没有发送额度时阻塞，直到对端归还额度或者流结束。
+func (s *Stream) Send(m message.Message) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	return s.conn.SendMsgCtx(s.ctx, s.frame(m, streamOpData))
+}
+
+// Recv 接收一个消息，对端结束发送后返回 io.EOF，流出错时返回对应的错误。
+func (s *Stream) Recv() (message.Message, error) {
+	select {
+	case m := <-s.recv:
+		return s.received(m), nil
+	default:
+	}
+
+	select {
+	case m := <-s.recv:
+		return s.received(m), nil
+	case <-s.recvDone:
+	case <-s.ctx.Done():
+	}
+
+	// 先返回已经收到的消息
+	select {
+	case m := <-s.recv:
+		return s.received(m), nil
+	default:
+	}
+	select {
+	case <-s.recvDone:
+		return nil, s.recvErr
+	default:
+		return nil, s.ctx.Err()
+	}
+}
+
+// CloseSend 结束本端的发送，对端 Recv 会返回 io.EOF。
+func (s *Stream) CloseSend() error {
+	s.mu.Lock()
+	if s.sendErr != nil {
+		err := s.sendErr
+		s.mu.Unlock()
+		return err
+	}
+	s.sendErr = code.ErrStreamClosed
+	s.mu.Unlock()
+
+	return s.conn.SendMsgCtx(s.ctx, s.frame(message.NewMsgWithMsgID(s.msgId), streamOpEnd))
+}
+
+// acquire 获取一个发送额度
+func (s *Stream) acquire() error {
+	for {
+		s.mu.Lock()
+		if s.sendErr != nil {
+			err := s.sendErr
+			s.mu.Unlock()
+			return err
+		}
+		if s.credits > 0 {
+			s.credits--
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.creditCh:
+		case <-s.ctx.Done():
+			s.mu.Lock()
+			err := s.sendErr
+			s.mu.Unlock()
+			if err == nil {
+				err = s.ctx.Err()
+			}
+			return err
+		}
+	}
+}
+
+func (s *Stream) addCredits(n int) {
+	s.mu.Lock()
+	s.credits += n
+	s.mu.Unlock()
+
+	select {
+	case s.creditCh <- struct{}{}:
+	default:
+	}
+}
+
+// received 消费一个消息，消费一半的窗口后归还额度
+func (s *Stream) received(m message.Message) message.Message {
+	s.consumed++
+	if s.consumed*2 >= s.window {
+		s.grant(s.consumed)
+		s.consumed = 0
+	}
+	return m
+}
+
+// grant 归还 n 个发送额度给对端
+func (s *Stream) grant(n int) {
+	credit := s.frame(message.NewMsgWithMsgID(s.msgId), streamOpCredit)
+	credit.SetHeader(message.MsgStreamCredit, strconv.Itoa(n))
+	// TODO log 发送失败
+	_ = s.conn.SendMsgCtx(s.ctx, credit)
+}
+
+// deliver 由连接的处理协程调用，按照顺序放入接收队列
+func (s *Stream) deliver(m message.Message) {
+	select {
+	case <-s.recvDone:
+		// 对端已经结束发送
+		return
+	default:
+	}
+
+	select {
+	case s.recv <- m:
+	default:
+		// 对端没有遵守流控
+		s.abort(code.ErrStreamFlowControl)
+	}
+}
+
+// endRecv 结束接收，Recv 取出剩余的消息后返回 err
+func (s *Stream) endRecv(err error) {
+	s.recvOnce.Do(func() {
+		s.recvErr = err
+		close(s.recvDone)
+	})
+}
+
+// terminate 结束流并释放资源，流已经结束时返回 false
+func (s *Stream) terminate(err error) bool {
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return false
+	}
+	s.done = true
+	if s.sendErr == nil {
+		s.sendErr = err
+	}
+	s.mu.Unlock()
+
+	s.endRecv(err)
+	s.conn.streams.remove(s.id)
+	s.cancel()
+	return true
+}
+
+// finish 接收方的处理函数返回后结束流，并通知发起方
+func (s *Stream) finish(err error) {
+	m := s.frame(message.NewMsgWithMsgID(s.msgId), streamOpClose)
+	if err != nil {
+		message.SetError(m, err)
+	} else {
+		err = code.ErrStreamClosed
+	}
+	if s.terminate(err) {
+		// TODO log 发送失败
+		_ = s.conn.SendMsgCtx(context.Background(), m)
+	}
+}
+
+// abort 本端出错时结束流，发起方发送 cancel，接收方发送 close。
+// 在连接的处理协程中调用，不会阻塞。
+func (s *Stream) abort(err error) {
+	m := message.NewMsgWithMsgID(s.msgId)
+	if s.initiator {
+		s.frame(m, streamOpCancel)
+	} else {
+		s.frame(m, streamOpClose)
+		message.SetError(m, err)
+	}
+	if s.terminate(err) {
+		// TODO log 发送失败
+		_ = s.conn.SendMsg(m)
+	}
+}
+
+// watch 发起方的上下文结束后取消流
+func (s *Stream) watch() {
+	<-s.ctx.Done()
+	if s.terminate(s.ctx.Err()) {
+		// TODO log 发送失败
+		_ = s.conn.SendMsg(s.frame(message.NewMsgWithMsgID(s.msgId), streamOpCancel))
+	}
+}
+
+// frame 设置流消息的消息头
+func (s *Stream) frame(m message.Message, op string) message.Message {
+	m.SetHeader(message.MsgTypeKey, message.MsgTypeStream.String())
+	m.SetHeader(message.MsgStreamId, strconv.FormatUint(s.id, 10))
+	m.SetHeader(message.MsgStreamOp, op)
+	return m
+}
+
+// streamSet 连接上的所有流
+type streamSet struct {
+	mu sync.Mutex
+	// 本端发起的下一个流的 id。客户端使用奇数，服务端使用偶数，双方发起的流不会冲突
+	nextId  uint64
+	streams map[uint64]*Stream
+	// 连接关闭后不能再创建流
+	closed bool
+}
+
+// add 记录流，连接已经关闭时返回 code.ErrConnClosed，id 重复时返回 code.ErrStreamDuplicate
+func (ss *streamSet) add(s *Stream) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return code.ErrConnClosed
+	}
+	if ss.streams[s.id] != nil {
+		return code.ErrStreamDuplicate
+	}
+	if ss.streams == nil {
+		ss.streams = make(map[uint64]*Stream)
+	}
+	ss.streams[s.id] = s
+	return nil
+}
+
+func (ss *streamSet) get(id uint64) *Stream {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.streams[id]
+}
+
+func (ss *streamSet) remove(id uint64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.streams, id)
+}
+
+// closeAll 连接关闭后结束所有的流
+func (ss *streamSet) closeAll(err error) {
+	ss.mu.Lock()
+	ss.closed = true
+	streams := make([]*Stream, 0, len(ss.streams))
+	for _, s := range ss.streams {
+		streams = append(streams, s)
+	}
+	ss.mu.Unlock()
+
+	for _, s := range streams {
+		s.terminate(err)
+	}
+}
+
+// setClient 标记为客户端的连接，发起的流使用奇数的 id，需要在 Start 之前调用
+func (t *tcpConn) setClient() {
+	t.streams.mu.Lock()
+	t.streams.nextId = 1
+	t.streams.mu.Unlock()
+}
+
+// NewStream 发起一个流，由 msgId 对应的流处理函数处理。ctx 结束后流被取消。
+func (t *tcpConn) NewStream(ctx context.Context, msgId uint32) (*Stream, error) {
+	t.streams.mu.Lock()
+	id := t.streams.nextId
+	t.streams.nextId += 2
+	t.streams.mu.Unlock()
+
+	s := newStream(ctx, t, id, msgId, true)
+	if err := t.streams.add(s); err != nil {
+		s.cancel()
+		return nil, err
+	}
+
+	open := s.frame(message.NewMsgWithMsgID(msgId), streamOpOpen)
+	open.SetHeader(message.MsgStreamCredit, strconv.Itoa(s.window))
+	if err := t.SendMsgCtx(ctx, open); err != nil {
+		s.terminate(err)
+		return nil, err
+	}
+
+	go s.watch()
+	return s, nil
+}
+
+// handleStream 由连接的处理协程按照顺序分发流消息，建立流时返回处理函数的上下文
+func (t *tcpConn) handleStream(m message.Message) *Context {
+	header := m.GetHeader()
+	id, err := strconv.ParseUint(header[message.MsgStreamId], 10, 64)
+	if err != nil {
+		// TODO log
+		return nil
+	}
+
+	if header[message.MsgStreamOp] == streamOpOpen {
+		s := newStream(context.Background(), t, id, m.GetMsgId(), false)
+		if err := t.streams.add(s); err != nil {
+			s.cancel()
+			if errors.Is(err, code.ErrStreamDuplicate) {
+				// TODO log 重复的流
+				// 不能结束已经存在的流，直接通知发起方
+				reject := s.frame(message.NewMsgWithMsgID(m.GetMsgId()), streamOpClose)
+				message.SetError(reject, err)
+				_ = t.SendMsg(reject)
+			}
+			return nil
+		}
+		credits, err := strconv.Atoi(header[message.MsgStreamCredit])
+		if err != nil || credits <= 0 {
+			credits = t.cfg.streamWindow
+		}
+		s.addCredits(credits)
+		// 告知发起方本端的接收窗口，不阻塞处理协程
+		go s.grant(s.window)
+
+		ctx := NewContext(s.ctx, m, t)
+		ctx.stream = s
+		return ctx
+	}
+
+	s := t.streams.get(id)
+	if s == nil {
+		// 流已经结束
+		return nil
+	}
+
+	switch header[message.MsgStreamOp] {
+	case streamOpData:
+		delete(header, message.MsgStreamId)
+		delete(header, message.MsgStreamOp)
+		s.deliver(m)
+	case streamOpEnd:
+		s.endRecv(io.EOF)
+	case streamOpClose:
+		if err := message.GetError(m); err != nil {
+			s.terminate(err)
+		} else {
+			s.endRecv(io.EOF)
+			s.terminate(code.ErrStreamClosed)
+		}
+	case streamOpCancel:
+		s.terminate(code.ErrStreamCanceled)
+	case streamOpCredit:
+		if n, err := strconv.Atoi(header[message.MsgStreamCredit]); err == nil && n > 0 {
+			s.addCredits(n)
+		}
+	}
+	return nil
+}
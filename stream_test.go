@@ -0,0 +1,309 @@
+package spider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/common"
+	"github.com/ywanbing/spider/message"
+)
+
+// newTestStreamPair 创建一对连接，服务端使用 srv 的路由
+func newTestStreamPair(t *testing.T, srv *TcpServer, opts ...ConnConfigOption) TcpConn {
+	c, s := newTestTCPPair(t)
+	cfg := defaultConnConfig
+	for _, opt := range opts {
+		cfg = opt(cfg)
+	}
+
+	server := NewTcpConn(s, cfg, srv.handleMessage)
+	server.Start()
+	client := NewTcpConn(c, cfg, func(ctx *Context) {})
+	client.Start()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client
+}
+
+func TestStream(t *testing.T) {
+	echoId := common.NewMsgIdWithSubMsgID(1, 1)
+	failId := common.NewMsgIdWithSubMsgID(1, 2)
+	waitId := common.NewMsgIdWithSubMsgID(1, 3)
+
+	canceled := make(chan struct{})
+	srv := NewTcpX()
+	srv.RegisterStreamHandler(1, 1, func(ctx *Context, s *Stream) error {
+		for {
+			m, err := s.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = s.Send(m); err != nil {
+				return err
+			}
+		}
+	})
+	srv.RegisterStreamHandler(1, 2, func(ctx *Context, s *Stream) error {
+		return errors.New("boom")
+	})
+	srv.RegisterStreamHandler(1, 3, func(ctx *Context, s *Stream) error {
+		<-ctx.GetCtx().Done()
+		close(canceled)
+		return nil
+	})
+	client := newTestStreamPair(t, srv, WithStreamWindow(4))
+
+	t.Run("echo", func(t *testing.T) {
+		s, err := client.NewStream(context.Background(), echoId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const n = 100
+		errs := make(chan error, 1)
+		go func() {
+			for i := 0; i < n; i++ {
+				if err := s.Send(newTestMsg(byte(i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- s.CloseSend()
+		}()
+
+		for i := 0; i < n; i++ {
+			m, err := s.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.GetBody()[0] != byte(i) {
+				t.Fatalf("want body %d, got %d", i, m.GetBody()[0])
+			}
+		}
+		if _, err = s.Recv(); err != io.EOF {
+			t.Fatalf("want io.EOF, got %v", err)
+		}
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		for id, want := range map[uint32]string{failId: "boom", common.NewMsgIdWithSubMsgID(2, 1): "stream route not found"} {
+			s, err := client.NewStream(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = s.Recv(); err == nil || err.Error() != want {
+				t.Fatalf("want %q, got %v", want, err)
+			}
+			if err = s.Send(newTestMsg(0)); err == nil {
+				t.Fatal("send after the stream is closed should fail")
+			}
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		s, err := client.NewStream(ctx, waitId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Fatal("handler context should be canceled")
+		}
+		if _, err = s.Recv(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("want context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestStream_Fragmentation(t *testing.T) {
+	const n = 3
+	srv := NewTcpX()
+	srv.RegisterStreamHandler(1, 1, func(ctx *Context, s *Stream) error {
+		for i := 0; i < n; i++ {
+			m := newTestMsg(byte(i))
+			m.SetBody(bytes.Repeat([]byte{byte(i)}, 64*1024))
+			if err := s.Send(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	client := newTestStreamPair(t, srv, WithFragmentation(1024))
+
+	s, err := client.NewStream(context.Background(), common.NewMsgIdWithSubMsgID(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 结束流的消息不能早于分片的数据发送
+	for i := 0; i < n; i++ {
+		m, err := s.Recv()
+		if err != nil {
+			t.Fatalf("recv %d of %d messages before %v", i, n, err)
+		}
+		if len(m.GetBody()) != 64*1024 || m.GetBody()[0] != byte(i) {
+			t.Fatalf("message %d mismatch", i)
+		}
+	}
+	if _, err = s.Recv(); err != io.EOF {
+		t.Fatalf("want io.EOF, got %v", err)
+	}
+}
+
+func TestStream_ConnClosed(t *testing.T) {
+	srv := NewTcpX()
+	srv.RegisterStreamHandler(1, 1, func(ctx *Context, s *Stream) error {
+		<-ctx.GetCtx().Done()
+		return nil
+	})
+	client := newTestStreamPair(t, srv)
+
+	s, err := client.NewStream(context.Background(), common.NewMsgIdWithSubMsgID(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.(*tcpConn).Stop()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Recv()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recv should return after the connection is closed")
+	}
+	if !errors.Is(err, code.ErrConnClosed) {
+		t.Fatalf("want ErrConnClosed, got %v", err)
+	}
+}
+
+func TestStream_Id(t *testing.T) {
+	streamId := common.NewMsgIdWithSubMsgID(1, 1)
+	srv := NewTcpX()
+	srv.RegisterStreamHandler(1, 1, func(ctx *Context, s *Stream) error {
+		<-ctx.GetCtx().Done()
+		return nil
+	})
+
+	c, s := newTestTCPPair(t)
+	server := NewTcpConn(s, srv.cfg, srv.handleMessage)
+	server.Start()
+	client := NewTcpClient("")
+	if !client.ready(NewTcpConn(c, client.cfg, client.handleMessage)) {
+		t.Fatal("client is closed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		_ = server.Close()
+	})
+
+	cs, err := client.NewStream(context.Background(), streamId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := server.NewStream(context.Background(), streamId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 双方同时发起的流不会冲突
+	if cs.Id()%2 != 1 || ss.Id()%2 != 0 {
+		t.Fatalf("stream id: client %d, server %d", cs.Id(), ss.Id())
+	}
+
+	// 请求流的路由回复错误
+	_, err = Invoke[testGreet, testGreet](context.Background(), client, streamId, testGreet{})
+	if !errors.Is(err, code.InvalidArgument) {
+		t.Fatalf("not a stream: want InvalidArgument, got %v", err)
+	}
+}
+
+func TestStream_Duplicate(t *testing.T) {
+	srv := NewTcpX()
+	srv.RegisterStreamHandler(1, 1, func(ctx *Context, s *Stream) error {
+		<-ctx.GetCtx().Done()
+		return nil
+	})
+	client := newTestStreamPair(t, srv)
+
+	s, err := client.NewStream(context.Background(), common.NewMsgIdWithSubMsgID(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 使用相同的 id 再次建立流，对端回复错误
+	open := s.frame(message.NewMsgWithMsgID(s.msgId), streamOpOpen)
+	if err = client.SendMsg(open); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Recv()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recv should return after the duplicate stream is rejected")
+	}
+	if err == nil || err.Error() != code.ErrStreamDuplicate.Error() {
+		t.Fatalf("want ErrStreamDuplicate, got %v", err)
+	}
+}
+
+func TestStream_Aborted(t *testing.T) {
+	srv := NewTcpX()
+	srv.RegisterGlobalMiddle(func(ctx *Context) {
+		ctx.Abort()
+	})
+	srv.RegisterStreamHandler(1, 1, func(ctx *Context, s *Stream) error {
+		return nil
+	})
+	client := newTestStreamPair(t, srv)
+
+	s, err := client.NewStream(context.Background(), common.NewMsgIdWithSubMsgID(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 中间件没有调用处理函数时，流也需要结束
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Recv()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recv should return after the middleware aborts")
+	}
+	if err == nil || err.Error() != code.ErrStreamAborted.Error() {
+		t.Fatalf("want ErrStreamAborted, got %v", err)
+	}
+
+	// 本端的 id 重复
+	conn := client.(*tcpConn)
+	conn.streams.mu.Lock()
+	conn.streams.nextId = s.Id()
+	conn.streams.streams[s.Id()] = s
+	conn.streams.mu.Unlock()
+	if _, err = client.NewStream(context.Background(), common.NewMsgIdWithSubMsgID(1, 1)); !errors.Is(err, code.ErrStreamDuplicate) {
+		t.Fatalf("want ErrStreamDuplicate, got %v", err)
+	}
+}
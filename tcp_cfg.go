@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"time"
 
+	"github.com/ywanbing/spider/codec"
 	"github.com/ywanbing/spider/proto"
 )
 
@@ -13,20 +14,64 @@ var defaultConnConfig = ConnConfig{
 	recvBufferSize:    16 * 1024,
 	binaryPoolMinSize: 512,
 	binaryPoolMaxSize: 512 * 1024,
+	maxFrameSize:      4 * 1024 * 1024,
+	maxMessageSize:    64 * 1024 * 1024,
+	reassemblyMemory:  256 * 1024 * 1024,
+	reassemblyTimeout: 30 * time.Second,
+	streamWindow:      64,
 	readTimeout:       3 * time.Second,
 	writeTimeout:      3 * time.Second,
+	slowConsumer:      SlowConsumerDropNewest,
+	writeBatchNum:     64,
+	writeBatchSize:    64 * 1024,
+	sendStarvation:    16,
+	reconnection:      true,
+	reconnectPolicy:   NewBackoffPolicy(),
 	onConnHandle: func(conn TcpConn) bool {
 		return true
 	},
-	p: proto.NewRawProto(),
+	p:       proto.NewRawProto(),
+	framer:  proto.NewDefaultFramer(),
+	metrics: defaultMetrics,
 }
 
+// SlowConsumerPolicy 发送队列已满（对端消费过慢）时 SendMsg 的处理策略。
+type SlowConsumerPolicy int32
+
+const (
+	// SlowConsumerDropNewest 丢弃当前要发送的消息，并返回 code.ErrSendQueueFull。默认策略。
+	SlowConsumerDropNewest SlowConsumerPolicy = iota
+	// SlowConsumerDropOldest 丢弃队列中最早的消息，为当前消息腾出位置。
+	// 已经入队的分片不会被丢弃，分片消息或者队列中全部是分片时，和 SlowConsumerDropNewest 一样丢弃当前的消息。
+	SlowConsumerDropOldest
+	// SlowConsumerDisconnect 队列持续满载超过指定时间后断开连接，
+	// 在此之前和 SlowConsumerDropNewest 一样返回 code.ErrSendQueueFull。
+	SlowConsumerDisconnect
+	// SlowConsumerBlock 阻塞直到队列有空间或者连接关闭。
+	SlowConsumerBlock
+)
+
 type ConnConfig struct {
-	// 发送消息缓冲区最大消息数量。默认值为1000。
+	// 发送消息缓冲区最大消息数量，每个优先级单独计算。默认值为1000。
 	maxSendMsgNum int32
 	// 接收消息缓冲区最大消息数量。默认值：10000。
 	maxRecvMsgNum int32
 
+	// 发送队列满时的处理策略。默认值：SlowConsumerDropNewest。
+	slowConsumer SlowConsumerPolicy
+	// SlowConsumerDisconnect 策略下，队列持续满载多久后断开连接。
+	slowConsumerTimeout time.Duration
+
+	// 低优先级的消息被高优先级的消息连续插队多少次后，优先发送一次，0 表示严格按照优先级发送。默认值：16。
+	sendStarvation int
+
+	// 发送时合并写入的最大消息数量，1 表示每条消息单独写入。默认值：64。
+	writeBatchNum int
+	// 发送时合并写入的最大字节数，超过后立即写入。默认值：64 * 1024（64K）。
+	writeBatchSize int
+	// 合并写入时等待更多消息的时间，类似 Nagle 算法。默认值：0（不等待）。
+	writeLinger time.Duration
+
 	// 接收缓冲区大小。默认值：16 * 1024（16K）。
 	recvBufferSize int32
 
@@ -36,6 +81,31 @@ type ConnConfig struct {
 	// NOTE：请根据实际的观测情况进行设置，以避免过多的内存占用。
 	binaryPoolMaxSize int
 
+	// 单个帧负载的最大长度（不包括长度字段），超过后视为协议错误。默认值：4 * 1024 * 1024（4M）。
+	maxFrameSize uint32
+	// 消息体超过该长度时拆分为多个分片发送，0 表示不拆分。默认值：0。
+	// 对端需要支持分片重组。
+	fragmentSize int
+	// 重组分片消息时，单个消息的最大长度。默认值：64 * 1024 * 1024（64M）。
+	maxMessageSize int
+	// 重组分片消息时，所有未完成的消息占用的最大内存。默认值：256 * 1024 * 1024（256M）。
+	reassemblyMemory int
+	// 从收到第一个分片开始，重组分片消息的超时时间。默认值：30s。
+	reassemblyTimeout time.Duration
+
+	// 每个流的接收窗口，对端最多可以发送多少个还没有被 Recv 的消息。默认值：64。
+	streamWindow int
+
+	// 请求处理函数的最长处理时间，和客户端传递的超时时间取较小值。默认值：0（不限制）。
+	maxHandlerTimeout time.Duration
+
+	// 发生协议错误时，是否在关闭连接前向对端发送错误帧。默认值：false。
+	protocolErrorFrame bool
+
+	// 是否在连接建立后交换前导信息，协商协议版本和能力。默认值：false。
+	// 双方都需要开启。
+	handshake bool
+
 	// 心跳控制 TODO
 	HeartBeatOn       bool
 	HeartBeatInterval time.Duration
@@ -55,12 +125,25 @@ type ConnConfig struct {
 
 	// 默认的协议解析
 	p proto.Proto
+	// 帧的划分方式。默认值：proto.NewDefaultFramer()（4 字节大端的长度字段）。
+	framer proto.Framer
+
+	// 监控指标。默认值：DefaultMetrics()。
+	metrics Metrics
 
 	// client config options
 	// Addr is the server address to connect to.
 	addr string
-	// 连接断开后是否自动重连
+	// 连接断开后是否自动重连。默认值：true。
 	reconnection bool
+	// 重连策略。默认值：NewBackoffPolicy()。
+	reconnectPolicy ReconnectPolicy
+	// 每次重连前调用，delay 为重连前等待的时间
+	onReconnecting func(attempt int, delay time.Duration)
+	// 重连成功后调用，attempt 为重连的次数
+	onReconnected func(conn TcpConn, attempt int)
+	// 放弃重连时调用，err 为最后一次重连的错误
+	onGiveUp func(err error)
 }
 
 type ConnConfigOption func(ConnConfig) ConnConfig
@@ -79,6 +162,63 @@ func WithMaxMsgNum(send, recv int32) ConnConfigOption {
 	}
 }
 
+// WithSlowConsumerPolicy sets the policy used by SendMsg when the send chan is full.
+// timeout is only used by SlowConsumerDisconnect.
+// default: SlowConsumerDropNewest
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy, timeout time.Duration) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		cfg.slowConsumer = policy
+		cfg.slowConsumerTimeout = timeout
+		return cfg
+	}
+}
+
+// WithPriorityStarvation sets how many times a lower priority frame can be
+// overtaken by higher priority frames before it is sent first.
+// 0 means strict priority.
+// default: 16
+func WithPriorityStarvation(n int) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if n >= 0 {
+			cfg.sendStarvation = n
+		}
+		return cfg
+	}
+}
+
+// WithMaxHandlerTimeout sets the max time a request handler may run.
+// The handler context is canceled after min(timeout, the deadline sent by the client).
+// 0 means no server side limit.
+// default: 0
+func WithMaxHandlerTimeout(timeout time.Duration) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if timeout >= 0 {
+			cfg.maxHandlerTimeout = timeout
+		}
+		return cfg
+	}
+}
+
+// WithWriteBatch sets the write coalescing of the send loop.
+// All messages currently in the send chan are written with one writev,
+// up to num messages or size bytes. If linger > 0, the send loop waits
+// up to linger for more messages before writing.
+// default: num=64, size=64*1024, linger=0
+func WithWriteBatch(num, size int, linger time.Duration) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if num > 0 {
+			cfg.writeBatchNum = num
+		}
+		if size > 0 {
+			cfg.writeBatchSize = size
+		}
+		if linger >= 0 {
+			cfg.writeLinger = linger
+		}
+		return cfg
+	}
+}
+
 // WithBinaryPoolSize sets the binary pool size.
 // default: min=512, max=512*1024
 func WithBinaryPoolSize(min, max int) ConnConfigOption {
@@ -93,6 +233,92 @@ func WithBinaryPoolSize(min, max int) ConnConfigOption {
 	}
 }
 
+// WithMaxFrameSize sets the max frame payload size, excluding the length field.
+// default: 4*1024*1024
+func WithMaxFrameSize(size uint32) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if size > 0 {
+			cfg.maxFrameSize = size
+		}
+		return cfg
+	}
+}
+
+// WithFragmentation splits outbound messages whose body is larger than chunkSize
+// into fragments, so that large messages don't need one big frame and other
+// messages can be interleaved between the fragments. chunkSize <= 0 disables it.
+// default: 0
+func WithFragmentation(chunkSize int) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if chunkSize < 0 {
+			chunkSize = 0
+		}
+		cfg.fragmentSize = chunkSize
+		return cfg
+	}
+}
+
+// WithReassembly sets the limits of reassembling fragmented messages:
+// the max size of one message, the max memory of all incomplete messages
+// of a connection and the timeout since the first fragment is received.
+// default: maxSize=64*1024*1024, maxMemory=256*1024*1024, timeout=30s
+func WithReassembly(maxSize, maxMemory int, timeout time.Duration) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if maxSize > 0 {
+			cfg.maxMessageSize = maxSize
+		}
+		if maxMemory > 0 {
+			cfg.reassemblyMemory = maxMemory
+		}
+		if timeout > 0 {
+			cfg.reassemblyTimeout = timeout
+		}
+		return cfg
+	}
+}
+
+// WithStreamWindow sets the receive window of each stream,
+// the max number of messages the peer can send before they are received by Recv.
+// default: 64
+func WithStreamWindow(window int) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if window > 0 {
+			cfg.streamWindow = window
+		}
+		return cfg
+	}
+}
+
+// WithProtocolErrorFrame sets whether to send an error frame to the peer
+// before closing the connection on protocol errors.
+func WithProtocolErrorFrame(on bool) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		cfg.protocolErrorFrame = on
+		return cfg
+	}
+}
+
+// WithHandshake enables the connection preface, both sides exchange magic,
+// protocol version and capabilities before any message.
+// The peer must enable it too.
+func WithHandshake() ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		cfg.handshake = true
+		return cfg
+	}
+}
+
+// WithMetrics sets the metrics.
+// default: DefaultMetrics()
+func WithMetrics(m Metrics) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if m != nil {
+			cfg.metrics = m
+		}
+		return cfg
+	}
+}
+
 // WithOnConnHandle sets the onConnHandle.
 func WithOnConnHandle(onConnHandle func(conn TcpConn) bool) ConnConfigOption {
 	return func(cfg ConnConfig) ConnConfig {
@@ -141,6 +367,18 @@ func WithProto(p proto.Proto) ConnConfigOption {
 	}
 }
 
+// WithFramer sets how frames are delimited on the stream,
+// the proto only handles the frame payload. Both sides must use the same framer.
+// default: proto.NewDefaultFramer()
+func WithFramer(f proto.Framer) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if f != nil {
+			cfg.framer = f
+		}
+		return cfg
+	}
+}
+
 // WithRecvBufferSize sets the recv buffer size.
 func WithRecvBufferSize(size int32) ConnConfigOption {
 	return func(cfg ConnConfig) ConnConfig {
@@ -175,3 +413,55 @@ func WithReconnection(reconnection bool) ConnConfigOption {
 		return cfg
 	}
 }
+
+// WithReconnectPolicy sets the reconnect policy of the client.
+// default: NewBackoffPolicy()
+func WithReconnectPolicy(p ReconnectPolicy) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		if p != nil {
+			cfg.reconnectPolicy = p
+		}
+		return cfg
+	}
+}
+
+// WithOnReconnecting sets the callback called before every reconnect attempt.
+func WithOnReconnecting(fn func(attempt int, delay time.Duration)) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		cfg.onReconnecting = fn
+		return cfg
+	}
+}
+
+// WithOnReconnected sets the callback called after the client is reconnected.
+func WithOnReconnected(fn func(conn TcpConn, attempt int)) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		cfg.onReconnected = fn
+		return cfg
+	}
+}
+
+// WithOnGiveUp sets the callback called when the reconnect policy gives up.
+// The client is closed after the callback returns.
+func WithOnGiveUp(fn func(err error)) ConnConfigOption {
+	return func(cfg ConnConfig) ConnConfig {
+		cfg.onGiveUp = fn
+		return cfg
+	}
+}
+
+// preface 根据配置生成本端的前导信息
+func (cfg ConnConfig) preface() proto.Preface {
+	p := proto.Preface{
+		Version:      proto.ProtoVersion,
+		Codecs:       codec.MarshalTypes(),
+		MaxFrameSize: cfg.maxFrameSize,
+	}
+	if cfg.HeartBeatOn {
+		p.HeartbeatInterval = cfg.HeartBeatInterval
+	}
+	if c, ok := cfg.p.(proto.Compressible); ok {
+		p.Compressions = c.Compressions()
+	}
+	return p
+}
@@ -2,7 +2,6 @@ package spider
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -10,11 +9,13 @@ import (
 	"time"
 
 	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/common"
 	"github.com/ywanbing/spider/message"
 )
 
 type TcpClient struct {
-	TcpConn
+	// 当前的连接，重连后被替换
+	*clientConn
 
 	cfg ConnConfig
 	// 处理消息的路由
@@ -25,7 +26,12 @@ type TcpClient struct {
 	mutex   sync.Mutex // protects following
 	seq     uint64
 	pending map[uint64]*Call
-	close   chan struct{}
+	// 连接状态，状态改变后关闭 stateChanged 并创建新的通道
+	state        ConnState
+	stateChanged chan struct{}
+	// 断线重连的协程是否在运行
+	watching bool
+	close    chan struct{}
 }
 
 // Call represents an active req.
@@ -34,9 +40,24 @@ type Call struct {
 	Reply message.Message
 	Error error      // After completion, the error status.
 	Done  chan *Call // Strobes when call is complete.
+
+	seq uint64
+	// 调用结束后关闭
+	finished chan struct{}
+}
+
+// newCall 创建一个调用，done 为 nil 时创建一个新的通道
+func newCall(req message.Message, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 10) // buffered. 依据 rpcx
+	} else if cap(done) == 0 {
+		panic("spider: done channel is unbuffered")
+	}
+	return &Call{req: req, Done: done, finished: make(chan struct{})}
 }
 
 func (call *Call) done() {
+	close(call.finished)
 	select {
 	case call.Done <- call:
 		// ok
@@ -54,32 +75,113 @@ func NewTcpClient(addr string, cfgOptions ...ConnConfigOption) *TcpClient {
 	}
 
 	return &TcpClient{
-		cfg:   cfg,
-		mux:   newMux(),
-		close: make(chan struct{}),
+		clientConn:   new(clientConn),
+		cfg:          cfg,
+		mux:          newMux(),
+		state:        Idle,
+		stateChanged: make(chan struct{}),
+		close:        make(chan struct{}),
 	}
 }
 
 // Start connects to the address on the named network.
+// 连接断开后按照 ReconnectPolicy 重连，关闭自动重连时回到 Idle 状态，可以再次调用 Start。
 func (t *TcpClient) Start() error {
-	conn, err := net.Dial("tcp", t.cfg.addr)
+	t.mutex.Lock()
+	switch t.state {
+	case Shutdown:
+		t.mutex.Unlock()
+		return code.ErrConnClosed
+	case Connecting, Ready:
+		// 已经启动
+		t.mutex.Unlock()
+		return nil
+	}
+	if t.watching {
+		// 正在重连，不需要再建立连接
+		t.mutex.Unlock()
+		return nil
+	}
+	t.setStateLocked(Connecting)
+	t.mutex.Unlock()
+
+	tcpConn, err := t.connect()
 	if err != nil {
+		t.setState(TransientFailure)
 		return err
 	}
+	if !t.ready(tcpConn) {
+		return code.ErrConnClosed
+	}
+
+	// 开启一个协程用来处理断线重连
+	t.mutex.Lock()
+	t.watching = true
+	t.mutex.Unlock()
+	go t.watch(tcpConn)
+
+	return nil
+}
+
+// connect 建立连接，完成前导协商后通过 onConnHandle 检查
+func (t *TcpClient) connect() (TcpConn, error) {
+	tcpConn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
 
-	tcpConn := NewTcpConn(conn.(*net.TCPConn), t.cfg, t.handleMessage)
 	if !t.cfg.onConnHandle(tcpConn) {
-		tcpConn.Close()
-		return fmt.Errorf("onConnHandle error")
+		_ = tcpConn.Close()
+		return nil, fmt.Errorf("onConnHandle error")
 	}
+	return tcpConn, nil
+}
 
-	t.TcpConn = tcpConn
-	t.TcpConn.Start()
+// dial 建立连接，并完成前导协商
+func (t *TcpClient) dial() (TcpConn, error) {
+	conn, err := net.Dial("tcp", t.cfg.addr)
+	if err != nil {
+		return nil, err
+	}
 
-	// 开启一个协程用来处理断线重连
-	go t.reconnect()
+	tcpConn := NewTcpConn(conn.(*net.TCPConn), t.cfg, t.handleMessage)
+	if err = tcpConn.Handshake(); err != nil {
+		_ = tcpConn.Close()
+		return nil, err
+	}
+	return tcpConn, nil
+}
 
-	return nil
+// ready 启动并使用新的连接，客户端已经关闭时关闭连接并返回 false
+func (t *TcpClient) ready(conn TcpConn) bool {
+	if c, ok := conn.(*tcpConn); ok {
+		// 客户端发起的流使用奇数的 id
+		c.setClient()
+	}
+	conn.Start()
+
+	t.mutex.Lock()
+	if t.state == Shutdown {
+		t.mutex.Unlock()
+		_ = conn.Close()
+		return false
+	}
+	t.clientConn.set(conn)
+	t.setStateLocked(Ready)
+	t.mutex.Unlock()
+	return true
+}
+
+// Addr 返回服务端的地址
+func (t *TcpClient) Addr() string {
+	return t.cfg.addr
+}
+
+// Pending 返回还没有结束的调用数量
+func (t *TcpClient) Pending() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.pending)
 }
 
 func (t *TcpClient) IsClose() bool {
@@ -91,70 +193,137 @@ func (t *TcpClient) IsClose() bool {
 	}
 }
 
+// Close 关闭客户端和当前的连接，未完成的调用返回 code.ErrConnClosed
 func (t *TcpClient) Close() {
 	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	select {
-	case <-t.close:
-	default:
-		close(t.close)
+	if !t.setStateLocked(Shutdown) {
+		t.mutex.Unlock()
+		return
+	}
+	close(t.close)
+	conn := t.clientConn.get()
+	pending := t.pending
+	t.pending = nil
+	t.mutex.Unlock()
+
+	if conn != nil {
+		_ = conn.Close()
+	}
+	for _, call := range pending {
+		call.Error = code.ErrConnClosed
+		call.done()
 	}
 }
 
-// reconnect 断线重连
-func (t *TcpClient) reconnect() {
-	defer t.Close()
-	// 断线重连策略
+// watch 连接断开后按照重连策略重连，放弃重连后关闭客户端
+func (t *TcpClient) watch(conn TcpConn) {
+	defer func() {
+		t.mutex.Lock()
+		t.watching = false
+		t.mutex.Unlock()
+	}()
 
-	reconnectTimes := 0
-	reconnectTime := 10 // 重连间隔
 	for {
 		select {
 		case <-t.close:
 			return
-		case <-t.TcpConn.StopNotifyChan():
-			if reconnectTimes > 10 {
-				// TODO log
-				return
-			}
-			time.Sleep(time.Duration(reconnectTime) * time.Millisecond)
-			reconnectTimes++
-			reconnectTime *= 2
-			if reconnectTime > 5000 {
-				reconnectTime = 5000
-			}
+		case <-conn.StopNotifyChan():
+		}
 
-			conn, err := net.Dial("tcp", t.cfg.addr)
-			if err != nil {
-				// TODO log
-				continue
+		if !t.cfg.reconnection {
+			// 和 watching 一起修改，避免 Start 看到 Idle 时重连协程还没有退出
+			t.mutex.Lock()
+			t.watching = false
+			t.setStateLocked(Idle)
+			t.mutex.Unlock()
+			return
+		}
+		if !t.setState(TransientFailure) {
+			return
+		}
+
+		var ok bool
+		if conn, ok = t.redial(); !ok {
+			t.Close()
+			return
+		}
+	}
+}
+
+// redial 按照重连策略重新建立连接，放弃重连或者客户端关闭时返回 false
+func (t *TcpClient) redial() (TcpConn, bool) {
+	start := time.Now()
+	var lastErr error = code.ErrConnClosed
+	for attempt := 1; ; attempt++ {
+		delay, ok := t.cfg.reconnectPolicy.Next(attempt, time.Since(start))
+		if !ok {
+			if t.cfg.onGiveUp != nil {
+				t.cfg.onGiveUp(lastErr)
 			}
+			return nil, false
+		}
+		if t.cfg.onReconnecting != nil {
+			t.cfg.onReconnecting(attempt, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-t.close:
+			timer.Stop()
+			return nil, false
+		case <-timer.C:
+		}
 
-			t.TcpConn = NewTcpConn(conn.(*net.TCPConn), t.cfg, t.handleMessage)
+		if !t.setState(Connecting) {
+			return nil, false
+		}
+		conn, err := t.connect()
+		if err != nil {
+			// TODO log
+			lastErr = err
+			t.setState(TransientFailure)
+			continue
+		}
 
-			t.TcpConn.Start()
-			reconnectTimes = 0
-			reconnectTime = 10
+		if !t.ready(conn) {
+			return nil, false
+		}
+		if t.cfg.onReconnected != nil {
+			t.cfg.onReconnected(conn, attempt)
 		}
+		return conn, true
 	}
 }
 
+// NewStream 发起一个流，由服务端 msgId 对应的流处理函数处理。ctx 结束后流被取消。
+func (t *TcpClient) NewStream(ctx context.Context, msgId uint32) (*Stream, error) {
+	if t.IsClose() {
+		return nil, code.ErrConnClosed
+	}
+	return t.clientConn.NewStream(ctx, msgId)
+}
+
 // RegisterGlobalMiddle add global routing middle handlers.
 func (t *TcpClient) RegisterGlobalMiddle(middles ...func(ctx *Context)) {
 	t.mux.RegisterGlobalMiddle(middles...)
 }
 
-// TcpClient 暂时只提供一个全局的路由中间件
+// 全局中间件用于发送的请求，模块中间件和消息中间件用于处理推送消息
+
+// RegisterModelMiddle add push routing middle handlers by modelID.
+func (t *TcpClient) RegisterModelMiddle(id modelID, middles ...func(ctx *Context)) {
+	t.mux.RegisterModelMiddle(id, middles...)
+}
 
-// RegisterModelMiddle add routing middle handlers by modelID.
-//func (t *TcpClient) RegisterModelMiddle(id modelID, middles ...func(ctx *Context)) {
-//	t.mux.RegisterModelMiddle(id, middles...)
-//}
+// RegisterHandler add push routing handlers by modelID and subMsgID.
+func (t *TcpClient) RegisterHandler(id modelID, subID subMsgID, handler func(ctx *Context), middles ...func(ctx *Context)) {
+	t.mux.RegisterHandler(id, subID, handler, middles...)
+}
 
-// RegisterHandler add routing handlers by modelID and subMsgID.
-//func (t *TcpClient) RegisterHandler(id modelID, subID subMsgID, handler func(ctx *Context), middles ...func(ctx *Context)) {
-//	t.mux.RegisterHandler(id, subID, handler, middles...)
-//}
+// SetNotFound sets the handler called when no push route matches.
+func (t *TcpClient) SetNotFound(handler func(ctx *Context)) {
+	t.mux.SetNotFound(handler)
+}
 
 // handleMessage 服务器处理消息
 func (t *TcpClient) handleMessage(ctx *Context) {
@@ -169,6 +338,9 @@ func (t *TcpClient) handleMessage(ctx *Context) {
 	case message.MsgTypeHeartBeat:
 		// 心跳消息
 		t.HandleHeartBeat(ctx)
+	case message.MsgTypeStream:
+		// 客户端不处理对端发起的流
+		ctx.Stream().finish(code.ErrStreamNotFound)
 	default:
 		//	TODO log
 	}
@@ -179,7 +351,6 @@ func (t *TcpClient) HandleReply(ctx *Context) {
 	// 回复的消息
 	respMsg := ctx.reqMsg
 	seq := respMsg.GetHeader()[message.MsgSeq]
-	errStr := respMsg.GetHeader()[message.MsgErr]
 	// 转成数字
 	seqNum, err := strconv.ParseUint(seq, 10, 64)
 	if err != nil {
@@ -187,25 +358,37 @@ func (t *TcpClient) HandleReply(ctx *Context) {
 		return
 	}
 
-	t.mutex.Lock()
-	call := t.pending[seqNum]
-	delete(t.pending, seqNum)
-	t.mutex.Unlock()
-	if call == nil {
-		// TODO log
+	if t.complete(seqNum, respMsg, message.GetError(respMsg)) == nil {
+		// TODO log 调用已经结束
 		return
 	}
-
-	call.Reply = respMsg
-	if errStr != "" {
-		call.Error = errors.New(errStr)
-	}
-	call.done()
 }
 
-// HandlePush 处理推送消息
+// HandlePush 处理推送消息，按照 模块中间件、消息中间件、处理函数 的顺序执行
 func (t *TcpClient) HandlePush(ctx *Context) {
+	msgId := ctx.reqMsg.GetMsgId()
+	modelId := common.GetModelId(msgId)
+	subMsgId := common.GetSubMsgId(msgId)
+
+	handler, ok := t.mux.Handlers[modelId]
+	if !ok || handler.Handlers[subMsgId] == nil {
+		if t.mux.NotFound != nil {
+			t.mux.NotFound(ctx)
+		}
+		// TODO: log
+		return
+	}
+
+	ctx.handlers = make([]func(c *Context), 0, len(handler.ModelMiddles)+len(handler.HandlerMiddles[subMsgId])+1)
+	// model middles
+	ctx.handlers = append(ctx.handlers, handler.ModelMiddles...)
+	// self-related middleware
+	ctx.handlers = append(ctx.handlers, handler.HandlerMiddles[subMsgId]...)
+	// handler
+	ctx.handlers = append(ctx.handlers, handler.Handlers[subMsgId])
 
+	// 执行
+	ctx.Next()
 }
 
 // HandleHeartBeat 处理心跳消息
@@ -213,52 +396,54 @@ func (t *TcpClient) HandleHeartBeat(ctx *Context) {
 
 }
 
-/*
-func (t *TcpClient) Go(c context.Context, req message.Message) *Call {
-	call := new(Call)
-	call.req = req
-	call.Done = make(chan *Call, 10) // buffered. 依据 rpcx
-	go t.send(c, call)
+// Go 异步发送请求，由客户端进行中间件的处理，调用结束后通过 Call.Done 通知。
+// 多个调用可以共用同一个 done，done 的容量需要足够容纳所有未结束的调用，否则结束通知会被丢弃。
+// done 为 nil 时创建一个新的通道。ctx 结束或者连接断开后调用结束。
+func (t *TcpClient) Go(c context.Context, req message.Message, done chan *Call) *Call {
+	call := newCall(req, done)
+	t.send(c, call, false)
 	return call
 }
 
-// send 发送消息，由客户端进行中间件的处理
-func (t *TcpClient) send(c context.Context, call *Call) {
-	defer func() {
-		if r := recover(); r != nil {
-			// TODO log
-			//log.Errorf("client send error is %v", r)
-		}
-		// write channel ,
-		if call != nil {
-			call.done()
-		}
-	}()
+// Call 发送消息，由客户端进行中间件的处理
+func (t *TcpClient) Call(c context.Context, req message.Message) (resp message.Message, err error) {
+	call := &Call{req: req, Done: make(chan *Call, 1), finished: make(chan struct{})}
+	t.send(c, call, true)
+	call = <-call.Done
+	return call.Reply, call.Error
+}
 
+// send 发送请求，由客户端进行中间件的处理。
+// wait 为 true 时在中间件中等待调用结束，否则在新的协程中等待。
+func (t *TcpClient) send(c context.Context, call *Call, wait bool) {
 	t.mutex.Lock()
 	// 检查客户端状态
-	if t.IsClose() {
+	conn := t.clientConn.get()
+	if t.IsClose() || conn == nil {
 		t.mutex.Unlock()
 		call.Error = code.ErrConnClosed
 		call.done()
 		return
 	}
-
 	if t.pending == nil {
 		t.pending = make(map[uint64]*Call)
 	}
 
-	seq := t.seq
+	call.seq = t.seq
 	t.seq++
-	t.pending[seq] = call
+	t.pending[call.seq] = call
 	t.mutex.Unlock()
 
 	// 设置消息头
-	call.req.SetHeader(message.MsgSeq, strconv.FormatUint(seq, 10))
+	call.req.SetHeader(message.MsgSeq, strconv.FormatUint(call.seq, 10))
 	call.req.SetHeader(message.MsgTypeKey, message.MsgTypeRequest.String())
+	// 告知服务端剩余的处理时间
+	if deadline, ok := c.Deadline(); ok {
+		call.req.SetHeader(message.MsgTimeout, time.Until(deadline).String())
+	}
 
 	// 创建自己的上下文
-	ctx := NewContext(c, call.req, t.TcpConn)
+	ctx := NewContext(c, call.req, conn)
 	if ctx.handlers == nil {
 		ctx.handlers = make([]func(c *Context), 0, len(t.mux.GlobalMiddles)+1)
 	}
@@ -266,92 +451,66 @@ func (t *TcpClient) send(c context.Context, call *Call) {
 	// global middleware
 	ctx.handlers = append(ctx.handlers, t.mux.GlobalMiddles...)
 
+	var sent bool
+
 	// handler
 	ctx.handlers = append(ctx.handlers, func(c *Context) {
-		err := t.TcpConn.SendMsg(c.reqMsg)
-		if err != nil {
-			call.Error = err
-			call.done()
+		sent = true
+		if err := conn.SendMsg(c.reqMsg); err != nil {
+			t.complete(call.seq, nil, err)
+			return
+		}
+
+		if wait {
+			t.wait(c.GetCtx(), call, conn)
+		} else {
+			go t.wait(c.GetCtx(), call, conn)
 		}
 	})
 
 	// 执行
-	if len(ctx.handlers) > 0 {
-		ctx.Next()
+	ctx.Next()
+	if !sent {
+		// 中间件没有发送请求
+		t.complete(call.seq, nil, code.ErrMessageNotSent)
 	}
-}*/
+}
 
-// Call 发送消息，由客户端进行中间件的处理
-func (t *TcpClient) Call(c context.Context, req message.Message) (resp message.Message, err error) {
-	// 检查客户端状态
-	if t.IsClose() {
-		t.mutex.Unlock()
-		return nil, code.ErrConnClosed
+// wait 等待调用结束，ctx 结束时取消请求，连接断开时返回 code.ErrConnClosed
+func (t *TcpClient) wait(c context.Context, call *Call, conn TcpConn) {
+	select {
+	case <-call.finished:
+	case <-c.Done():
+		if t.complete(call.seq, nil, c.Err()) != nil {
+			// 通知服务端取消处理
+			// TODO log 发送失败
+			_ = conn.SendMsg(newCancelMsg(call.req.GetMsgId(), call.seq))
+		}
+	case <-conn.StopNotifyChan():
+		t.complete(call.seq, nil, code.ErrConnClosed)
 	}
+}
 
-	call := new(Call)
-	call.req = req
-	call.Done = make(chan *Call, 10) // buffered. 依据 rpcx
+// complete 结束 seq 对应的调用，调用已经结束时返回 nil
+func (t *TcpClient) complete(seq uint64, reply message.Message, err error) *Call {
 	t.mutex.Lock()
-	if t.pending == nil {
-		t.pending = make(map[uint64]*Call)
-	}
-
-	seq := t.seq
-	t.seq++
-	t.pending[seq] = call
+	call := t.pending[seq]
+	delete(t.pending, seq)
 	t.mutex.Unlock()
-
-	// 设置消息头
-	call.req.SetHeader(message.MsgSeq, strconv.FormatUint(seq, 10))
-	call.req.SetHeader(message.MsgTypeKey, message.MsgTypeRequest.String())
-
-	// 创建自己的上下文
-	ctx := NewContext(c, req, t.TcpConn)
-	if ctx.handlers == nil {
-		ctx.handlers = make([]func(c *Context), 0, len(t.mux.GlobalMiddles)+1)
+	if call == nil {
+		return nil
 	}
 
-	// global middleware
-	ctx.handlers = append(ctx.handlers, t.mux.GlobalMiddles...)
-
-	var send bool
-
-	// handler
-	ctx.handlers = append(ctx.handlers, func(c *Context) {
-		err := t.TcpConn.SendMsg(c.reqMsg)
-		if err != nil {
-			t.mutex.Lock()
-			delete(t.pending, seq)
-			t.mutex.Unlock()
-			call.Error = err
-			call.done()
-		}
-
-		send = true
-
-		select {
-		case call = <-call.Done:
-		case <-c.ctx.Done():
-			t.mutex.Lock()
-			delete(t.pending, seq)
-			t.mutex.Unlock()
-			call.Error = c.ctx.Err()
-			call.done()
-		}
-	})
-
-	// 执行
-	defer func() {
-		if !send {
-			t.mutex.Lock()
-			delete(t.pending, seq)
-			t.mutex.Unlock()
-			call.Error = code.ErrMessageNotSent
-			call.done()
-		}
-	}()
-	ctx.Next()
+	call.Reply = reply
+	call.Error = err
+	call.done()
+	return call
+}
 
-	return call.Reply, call.Error
+// newCancelMsg 创建取消请求的消息
+func newCancelMsg(msgId uint32, seq uint64) message.Message {
+	m := message.NewMsgWithMsgID(msgId)
+	m.SetHeader(message.MsgTypeKey, message.MsgTypeCancel.String())
+	m.SetHeader(message.MsgSeq, strconv.FormatUint(seq, 10))
+	return m
 }
@@ -0,0 +1,319 @@
+package spider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/common"
+	"github.com/ywanbing/spider/message"
+	"github.com/ywanbing/spider/proto"
+)
+
+// newTestClient 创建一个连接到 srv 的客户端
+func newTestClient(t *testing.T, srv *TcpServer, opts ...ConnConfigOption) *TcpClient {
+	client := NewTcpClient("", opts...)
+	newTestClientConn(t, srv, client)
+	return client
+}
+
+// newTestClientConn 为 client 创建一个连接到 srv 的连接
+func newTestClientConn(t *testing.T, srv *TcpServer, client *TcpClient) {
+	c, s := newTestTCPPair(t)
+	server := NewTcpConn(s, srv.cfg, srv.handleMessage)
+	server.Start()
+	if !client.ready(NewTcpConn(c, client.cfg, client.handleMessage)) {
+		t.Fatal("client is closed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		_ = server.Close()
+	})
+}
+
+func TestTcpClient_CallCancel(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan error, 1)
+	srv := NewTcpX()
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		close(started)
+		select {
+		case <-ctx.GetCtx().Done():
+			canceled <- ctx.GetCtx().Err()
+		case <-time.After(time.Second):
+			canceled <- nil
+		}
+	})
+	client := newTestClient(t, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	req := message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 1))
+	if _, err := client.Call(ctx, req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("handler context should be canceled, got %v", err)
+	}
+}
+
+func TestTcpClient_CallDeadline(t *testing.T) {
+	reqId := common.NewMsgIdWithSubMsgID(1, 1)
+	deadlines := make(chan time.Duration, 1)
+	srv := NewTcpX(WithMaxHandlerTimeout(time.Second))
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		deadline, ok := ctx.GetCtx().Deadline()
+		if !ok {
+			deadlines <- 0
+		} else {
+			deadlines <- time.Until(deadline)
+		}
+		_ = ctx.Raw(reqId, []byte("ok"))
+	})
+	client := newTestClient(t, srv)
+
+	for name, tt := range map[string]struct {
+		timeout time.Duration
+		max     time.Duration
+	}{
+		"client": {timeout: 200 * time.Millisecond, max: 200 * time.Millisecond},
+		"server": {timeout: time.Hour, max: time.Second},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			if _, err := client.Call(ctx, message.NewMsgWithMsgID(reqId)); err != nil {
+				t.Fatal(err)
+			}
+			if d := <-deadlines; d <= 0 || d > tt.max {
+				t.Fatalf("handler deadline should be in (0, %v], got %v", tt.max, d)
+			}
+		})
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		req := message.NewMsgWithMsgID(reqId)
+		req.SetHeader(message.MsgTimeout, (-time.Millisecond).String())
+		_, err := client.Call(context.Background(), req)
+		if !errors.Is(err, code.DeadlineExceeded) {
+			t.Fatalf("want %v, got %v", code.ErrDeadlineExceeded, err)
+		}
+		select {
+		case <-deadlines:
+			t.Fatal("expired request should not be handled")
+		default:
+		}
+	})
+}
+
+func TestTcpClient_CallError(t *testing.T) {
+	srv := NewTcpX()
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		_ = ctx.Error(code.NotFound, "user not found")
+	})
+	srv.RegisterHandler(1, 2, func(ctx *Context) {
+		_ = ctx.ReplyError(code.Errorf(1001, "balance %d", 0).WithDetails(map[string]string{"account": "a1"}))
+	})
+	srv.RegisterHandler(1, 3, func(ctx *Context) {
+		_ = ctx.ReplyError(errors.New("boom"))
+	})
+	client := newTestClient(t, srv)
+
+	_, err := client.Call(context.Background(), message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 1)))
+	if !errors.Is(err, code.NotFound) || errors.Is(err, code.Internal) {
+		t.Fatalf("want NotFound, got %v", err)
+	}
+
+	_, err = client.Call(context.Background(), message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 2)))
+	var e *code.Error
+	if !errors.As(err, &e) {
+		t.Fatalf("want *code.Error, got %T", err)
+	}
+	if e.Code != 1001 || e.Message != "balance 0" || e.Details["account"] != "a1" {
+		t.Fatalf("unexpected error: %+v", e)
+	}
+
+	_, err = client.Call(context.Background(), message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 3)))
+	if err == nil || err.Error() != "boom" || code.CodeOf(err) != code.Unknown {
+		t.Fatalf("want boom, got %v", err)
+	}
+}
+
+func TestTcpClient_Go(t *testing.T) {
+	srv := NewTcpX()
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		_ = ctx.Raw(ctx.GetReqMsgId(), ctx.RawData())
+	})
+	srv.RegisterHandler(1, 2, func(ctx *Context) {
+		_ = ctx.conn.Close()
+	})
+	client := newTestClient(t, srv)
+
+	t.Run("pipeline", func(t *testing.T) {
+		const n = 300
+		done := make(chan *Call, n)
+		calls := make(map[*Call]byte, n)
+		for i := 0; i < n; i++ {
+			req := message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 1))
+			req.SetBody([]byte{byte(i)})
+			call := client.Go(context.Background(), req, done)
+			calls[call] = byte(i)
+		}
+
+		for i := 0; i < n; i++ {
+			var call *Call
+			select {
+			case call = <-done:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("only %d of %d calls completed", i, n)
+			}
+			want, ok := calls[call]
+			if !ok {
+				t.Fatal("unexpected call")
+			}
+			delete(calls, call)
+			if call.Error != nil {
+				t.Fatal(call.Error)
+			}
+			if got := call.Reply.GetBody()[0]; got != want {
+				t.Fatalf("want body %d, got %d", want, got)
+			}
+		}
+	})
+
+	t.Run("conn closed", func(t *testing.T) {
+		call := client.Go(context.Background(), message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 2)), nil)
+		select {
+		case <-call.Done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("call should complete after the connection is closed")
+		}
+		if !errors.Is(call.Error, code.ErrConnClosed) {
+			t.Fatalf("want ErrConnClosed, got %v", call.Error)
+		}
+	})
+}
+
+func TestTcpClient_HandlePush(t *testing.T) {
+	chatId := common.NewMsgIdWithSubMsgID(2, 1)
+	srv := NewTcpX()
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		for _, id := range []uint32{chatId, common.NewMsgIdWithSubMsgID(2, 2)} {
+			push := message.NewMsgWithMsgID(id)
+			push.SetHeader(message.MsgTypeKey, message.MsgTypePush.String())
+			_ = ctx.conn.SendMsg(push)
+		}
+		_ = ctx.Raw(ctx.GetReqMsgId(), []byte("ok"))
+	})
+	client := NewTcpClient("")
+
+	var trace []string
+	pushed := make(chan []string, 1)
+	notFound := make(chan uint32, 1)
+	client.RegisterModelMiddle(2, func(ctx *Context) {
+		trace = append(trace, "model")
+		ctx.Next()
+	})
+	client.RegisterHandler(2, 1, func(ctx *Context) {
+		pushed <- append(trace, "handler")
+	}, func(ctx *Context) {
+		trace = append(trace, "middle")
+		ctx.Next()
+	})
+	client.SetNotFound(func(ctx *Context) {
+		notFound <- ctx.GetReqMsgId()
+	})
+	newTestClientConn(t, srv, client)
+
+	if _, err := client.Call(context.Background(), message.NewMsgWithMsgID(common.NewMsgIdWithSubMsgID(1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-pushed:
+			if len(got) != 3 || got[0] != "model" || got[1] != "middle" || got[2] != "handler" {
+				t.Fatalf("unexpected handler order: %v", got)
+			}
+		case id := <-notFound:
+			if id != common.NewMsgIdWithSubMsgID(2, 2) {
+				t.Fatalf("unexpected not found msg id: %d", id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("push should be handled")
+		}
+	}
+}
+
+func TestTcpServer_NotFound(t *testing.T) {
+	srv := NewTcpX()
+	srv.RegisterHandler(1, 1, func(ctx *Context) {
+		_ = ctx.Raw(ctx.GetReqMsgId(), []byte("ok"))
+	})
+	srv.SetNotFound(func(ctx *Context) {
+		_ = ctx.Error(code.NotFound, "no route")
+	})
+	client := newTestClient(t, srv)
+
+	// 模块不存在和消息不存在时都调用 NotFound
+	for _, id := range []uint32{common.NewMsgIdWithSubMsgID(2, 1), common.NewMsgIdWithSubMsgID(1, 2)} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := client.Call(ctx, message.NewMsgWithMsgID(id))
+		cancel()
+		if !errors.Is(err, code.NotFound) {
+			t.Fatalf("msg id %d: want NotFound, got %v", id, err)
+		}
+	}
+}
+
+// uncomparableProto 不可比较的 Proto，作为接口比较时会 panic
+type uncomparableProto struct {
+	proto.Proto
+	_ []byte
+}
+
+func TestTcpServer_Broadcast(t *testing.T) {
+	p := uncomparableProto{Proto: proto.NewRawProto()}
+	srv := NewTcpX(WithProto(p))
+	pushed := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		c, s := newTestTCPPair(t)
+		server := NewTcpConn(s, srv.cfg, srv.handleMessage)
+		server.SetConnId(uint64(i + 1))
+		srv.connMapLock.Lock()
+		srv.connMap[server.GetConnId()] = server
+		srv.connMapLock.Unlock()
+		server.Start()
+
+		client := NewTcpClient("", WithProto(p))
+		client.RegisterHandler(1, 1, func(ctx *Context) {
+			pushed <- string(ctx.RawData())
+		})
+		if !client.ready(NewTcpConn(c, client.cfg, client.handleMessage)) {
+			t.Fatal("client is closed")
+		}
+		t.Cleanup(func() {
+			client.Close()
+			_ = server.Close()
+		})
+	}
+
+	// 使用默认 Proto 的连接共享同一个帧，不比较 Proto 的值
+	if err := srv.Broadcast(message.NewMessage(common.NewMsgIdWithSubMsgID(1, 1), 'R', map[string]string{}, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-pushed:
+			if got != "hello" {
+				t.Fatalf("want hello, got %q", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("broadcast should be received")
+		}
+	}
+}
@@ -3,12 +3,14 @@ package spider
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
 	"errors"
-	"io"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ywanbing/spider/code"
 	"github.com/ywanbing/spider/common"
 	"github.com/ywanbing/spider/message"
 	"github.com/ywanbing/spider/proto"
@@ -22,12 +24,35 @@ type TcpConn interface {
 	GetConnId() uint64
 	SetConnId(uint64)
 
+	// Handshake 交换连接前导信息并协商连接参数，需要在 Start 之前调用。
+	// 没有开启 WithHandshake 时直接返回。
+	Handshake() error
+	// Negotiated 返回协商后的连接参数，没有进行协商时返回 nil。
+	Negotiated() *proto.Negotiated
+	// GetProto 返回连接使用的 Proto，协商后可能是该连接专用的实例。
+	GetProto() proto.Proto
+
 	Start()
 
+	// SendMsg 按照连接的 SlowConsumerPolicy 发送消息。
 	SendMsg(message.Message) error
+	// SendMsgCtx 阻塞直到发送队列有空间、ctx 结束或者连接关闭。
+	SendMsgCtx(context.Context, message.Message) error
+	// SendFrame 按照连接的 SlowConsumerPolicy 发送已经打包好的帧，
+	// 写入完成或者发送失败后释放一次引用。共享的帧需要调用方先 Retain。
+	SendFrame(*common.Frame) error
+
+	// NewStream 发起一个流，由对端 msgId 对应的流处理函数处理。ctx 结束后流被取消。
+	NewStream(ctx context.Context, msgId uint32) (*Stream, error)
+
+	// SetSlowConsumerPolicy 设置当前连接发送队列满时的处理策略，
+	// 默认使用 ConnConfig 中的配置。
+	SetSlowConsumerPolicy(policy SlowConsumerPolicy, timeout time.Duration)
 
 	// StopNotifyChan 关闭的时候，需要被通知
 	StopNotifyChan() chan struct{}
+	// CloseReason 返回连接关闭的原因，连接未关闭或者正常关闭时返回 nil。
+	CloseReason() error
 }
 
 type tcpConn struct {
@@ -43,30 +68,73 @@ type tcpConn struct {
 	// connId 连接id
 	connId uint64
 
+	// 帧的划分方式，使用连接的缓存池和最大帧长度
+	framer proto.Framer
+
+	// 协商后的连接参数
+	negotiated *proto.Negotiated
+	// Proto 被前导协商替换为该连接专用的实例
+	dedicatedProto bool
+	// 发送帧的最大长度，协商后取双方的最小值
+	maxSendFrameSize uint32
+
 	// byte数组 缓存池
 	bufferPool *common.LimitedPool
 
 	// 收发消息的通道
-	recvChan chan []byte
-	sendChan chan []byte
-
-	stop           bool
+	recvChan  chan []byte
+	sendQueue *sendQueue
+
+	// 发送队列满时的处理策略
+	slowConsumer        atomic.Int32
+	slowConsumerTimeout atomic.Int64
+	// 发送队列开始持续满载的时间（UnixNano），0 表示未满载
+	fullSince atomic.Int64
+
+	// 每个优先级一个锁，打包和入队在锁内完成，队列中帧的顺序和打包的顺序一致，
+	// 这样 EncryptTransform 在同一个 lane 内分配的计数器按照递增的顺序写入，不会被对端当作重放，
+	// 被丢弃的帧只会留下空洞。持有锁时不会等待队列的空间，见 sendWait。
+	packMu [priorityLevels]sync.Mutex
+	// 分片消息的 id
+	fragmentId atomic.Uint64
+	// 重组收到的分片消息
+	reassembler *reassembler
+
+	// 连接上的流
+	streams streamSet
+	// 正在处理的请求，用于取消
+	inflight inflightSet
+
+	// 连接关闭的原因
+	closeMu     sync.Mutex
+	closeReason error
+
+	stopOnce       sync.Once
 	stopNotifyChan chan struct{}
 }
 
 var _ TcpConn = new(tcpConn)
 
 func NewTcpConn(conn *net.TCPConn, cfg ConnConfig, handleFunc func(ctx *Context)) TcpConn {
-	return &tcpConn{
-		TCPConn:        conn,
-		Proto:          cfg.p,
-		cfg:            cfg,
-		handleFunc:     handleFunc,
-		bufferPool:     common.NewLimitedPool(cfg.binaryPoolMinSize, cfg.binaryPoolMaxSize),
-		recvChan:       make(chan []byte, cfg.maxRecvMsgNum),
-		sendChan:       make(chan []byte, cfg.maxSendMsgNum),
-		stopNotifyChan: make(chan struct{}),
+	t := &tcpConn{
+		TCPConn:          conn,
+		Proto:            cfg.p,
+		cfg:              cfg,
+		handleFunc:       handleFunc,
+		maxSendFrameSize: cfg.maxFrameSize,
+		bufferPool:       common.NewLimitedPool(cfg.binaryPoolMinSize, cfg.binaryPoolMaxSize),
+		recvChan:         make(chan []byte, cfg.maxRecvMsgNum),
+		sendQueue:        newSendQueue(cfg.maxSendMsgNum, cfg.sendStarvation),
+		reassembler:      newReassembler(cfg.maxMessageSize, cfg.reassemblyMemory, cfg.reassemblyTimeout),
+		streams:          streamSet{nextId: 2},
+		stopNotifyChan:   make(chan struct{}),
 	}
+	t.framer = cfg.framer
+	if l, ok := cfg.framer.(proto.FrameLimiter); ok {
+		t.framer = l.WithLimit(cfg.maxFrameSize, t.bufferPool.Get)
+	}
+	t.SetSlowConsumerPolicy(cfg.slowConsumer, cfg.slowConsumerTimeout)
+	return t
 }
 
 func (t *tcpConn) GetConnId() uint64 {
@@ -83,21 +151,74 @@ func (t *tcpConn) SetConnId(connId uint64) {
 	t.connId = connId
 }
 
+func (t *tcpConn) Handshake() error {
+	if !t.cfg.handshake {
+		return nil
+	}
+
+	_ = t.SetDeadline(time.Now().Add(t.cfg.readTimeout))
+	defer t.SetDeadline(time.Time{})
+
+	local := t.cfg.preface()
+	if err := proto.WritePreface(t.TCPConn, local); err != nil {
+		return err
+	}
+	peer, err := proto.ReadPreface(t.TCPConn)
+	if err != nil {
+		return err
+	}
+
+	n, err := proto.Negotiate(local, peer)
+	if err != nil {
+		return err
+	}
+	t.negotiated = &n
+	t.maxSendFrameSize = n.MaxFrameSize
+
+	// 由 Proto 生成该连接专用的实例，例如使用协商后的压缩算法
+	if h, ok := t.Proto.(proto.Handshaker); ok {
+		p, err := h.Handshake(t.TCPConn, n)
+		if err != nil {
+			return err
+		}
+		t.Proto = p
+		t.dedicatedProto = true
+	}
+	return nil
+}
+
+func (t *tcpConn) Negotiated() *proto.Negotiated {
+	return t.negotiated
+}
+
+func (t *tcpConn) GetProto() proto.Proto {
+	return t.Proto
+}
+
+// usesDefaultProto 连接是否使用配置中的 Proto，可以直接发送广播共享的帧
+func (t *tcpConn) usesDefaultProto() bool {
+	return !t.dedicatedProto
+}
+
 func (t *tcpConn) Start() {
 	go t.handFunc()
 	go t.send()
 }
 
+func (t *tcpConn) SetSlowConsumerPolicy(policy SlowConsumerPolicy, timeout time.Duration) {
+	t.slowConsumer.Store(int32(policy))
+	t.slowConsumerTimeout.Store(int64(timeout))
+}
+
+// Stop 关闭连接并通知所有等待的协程，可以重复调用。
+// 收发通道不会被关闭，避免并发发送时 panic。
 func (t *tcpConn) Stop() {
-	if t.IsStop() {
-		return
-	}
-	t.stop = true
-	_ = t.Close()
-	close(t.recvChan)
-	close(t.sendChan)
-	close(t.stopNotifyChan)
-	return
+	t.stopOnce.Do(func() {
+		_ = t.Close()
+		close(t.stopNotifyChan)
+		t.streams.closeAll(code.ErrConnClosed)
+		t.inflight.closeAll()
+	})
 }
 
 func (t *tcpConn) StopNotifyChan() chan struct{} {
@@ -105,110 +226,602 @@ func (t *tcpConn) StopNotifyChan() chan struct{} {
 }
 
 func (t *tcpConn) IsStop() bool {
-	return t.stop
+	select {
+	case <-t.stopNotifyChan:
+		return true
+	default:
+		return false
+	}
 }
 
 func (t *tcpConn) recv() {
-	defer t.Stop()
-	sizeByte := make([]byte, 4)
+	t.closeWithReason(t.readLoop())
+}
 
+// readLoop 循环读取消息，返回导致连接关闭的原因
+func (t *tcpConn) readLoop() error {
 	reader := bufio.NewReaderSize(t, int(t.cfg.recvBufferSize))
 	for {
 		if t.IsStop() {
-			return
+			return nil
 		}
 
-		_, err := io.ReadFull(reader, sizeByte)
+		// 对端关闭连接、协议错误或者其他错误
+		data, err := t.framer.ReadFrame(reader)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				continue
-			} else {
-				// 关闭连接或者其他错误
-				return
-			}
+			return err
 		}
-
-		// 读取消息长度
-		allSize := binary.BigEndian.Uint32(sizeByte)
-		data := t.bufferPool.Get(int(allSize - proto.MsgSize))
-
-		_, err = io.ReadFull(reader, data)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				continue
-			} else {
-				// 关闭连接或者其他错误
-				return
-			}
+		// 自定义的 Framer 可能没有限制帧的长度
+		if uint32(len(data)) > t.cfg.maxFrameSize {
+			return code.NewProtocolError(code.ReasonFrameTooLarge,
+				fmt.Errorf("%w: %d > %d", code.ErrFrameTooLarge, len(data), t.cfg.maxFrameSize))
 		}
 
 		select {
 		case t.recvChan <- data:
 		default:
 			// 一直没有读取，直接关闭连接
-			return
+			return code.ErrRecvQueueFull
 		}
 	}
 }
 
+// CloseReason 返回连接关闭的原因，连接未关闭或者正常关闭时返回 nil。
+func (t *tcpConn) CloseReason() error {
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+	return t.closeReason
+}
+
+// closeWithReason 记录关闭的原因并关闭连接。
+// 如果是协议错误，会记录监控指标，并按照配置在关闭前向对端发送错误帧。
+func (t *tcpConn) closeWithReason(reason error) {
+	if t.IsStop() {
+		return
+	}
+
+	t.closeMu.Lock()
+	if t.closeReason == nil {
+		t.closeReason = reason
+	}
+	t.closeMu.Unlock()
+
+	var pe *code.ProtocolError
+	if !errors.As(reason, &pe) {
+		t.Stop()
+		return
+	}
+
+	t.cfg.metrics.IncProtocolError(pe.Reason)
+	if !t.cfg.protocolErrorFrame {
+		t.Stop()
+		return
+	}
+
+	// 错误帧写入后，由发送协程关闭连接
+	m := message.NewMsgWithMsgID(0)
+	m.SetHeader(message.MsgTypeKey, message.MsgTypeError.String())
+	m.SetHeader(message.MsgErr, pe.Error())
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.writeTimeout)
+	defer cancel()
+	if err := t.sendWait(ctx, m, true); err != nil {
+		t.Stop()
+		return
+	}
+	// 避免错误帧一直没有写入
+	time.AfterFunc(t.cfg.writeTimeout, t.Stop)
+}
+
 func (t *tcpConn) SendMsg(data message.Message) error {
-	msg, err := t.Pack(data)
+	if t.IsStop() {
+		return code.ErrConnClosed
+	}
+	if t.shouldFragment(data) {
+		return t.sendFragments(context.Background(), data, true)
+	}
+	return t.sendByPolicy(data)
+}
+
+func (t *tcpConn) SendMsgCtx(ctx context.Context, data message.Message) error {
+	if t.IsStop() {
+		return code.ErrConnClosed
+	}
+	if t.shouldFragment(data) {
+		return t.sendFragments(ctx, data, false)
+	}
+	return t.sendWait(ctx, data, false)
+}
+
+func (t *tcpConn) SendFrame(f *common.Frame) error {
+	err := t.enqueueByPolicy(f)
+	if err != nil {
+		f.Release()
+	}
+	return err
+}
+
+// enqueueByPolicy 按照连接的 SlowConsumerPolicy 把帧放入发送队列
+func (t *tcpConn) enqueueByPolicy(f *common.Frame) error {
+	switch SlowConsumerPolicy(t.slowConsumer.Load()) {
+	case SlowConsumerDropOldest:
+		return t.enqueueDropOldest(f)
+	case SlowConsumerDisconnect:
+		return t.enqueueOrDisconnect(f)
+	case SlowConsumerBlock:
+		return t.enqueue(context.Background(), f)
+	default:
+		return t.enqueueOrDrop(f)
+	}
+}
+
+func (t *tcpConn) shouldFragment(m message.Message) bool {
+	return t.cfg.fragmentSize > 0 && len(m.GetBody()) > t.cfg.fragmentSize
+}
+
+// sendFragments 拆分消息并逐个发送分片，其他消息可以穿插在分片之间。
+// usePolicy 为 true 时，第一个分片按照 SlowConsumerPolicy 发送，被丢弃时整个消息被丢弃；
+// 之后的分片阻塞发送，避免对端收到不完整的消息。
+func (t *tcpConn) sendFragments(ctx context.Context, m message.Message, usePolicy bool) error {
+	id := t.fragmentId.Add(1)
+	return splitMessage(m, id, t.cfg.fragmentSize, func(fm message.Message) error {
+		if usePolicy {
+			usePolicy = false
+			return t.sendByPolicy(fm)
+		}
+		return t.sendWait(ctx, fm, false)
+	})
+}
+
+// sendByPolicy 打包消息并按照连接的 SlowConsumerPolicy 放入发送队列
+func (t *tcpConn) sendByPolicy(m message.Message) error {
+	if SlowConsumerPolicy(t.slowConsumer.Load()) == SlowConsumerBlock {
+		return t.sendWait(context.Background(), m, false)
+	}
+
+	mu := &t.packMu[levelOf(priorityOf(m))]
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, err := t.packFrame(m)
 	if err != nil {
 		return err
 	}
+	if err = t.enqueueByPolicy(f); err != nil {
+		f.Release()
+	}
+	return err
+}
+
+// sendWait 打包消息并阻塞直到放入发送队列、ctx 结束或者连接关闭，final 为 true 时写入后关闭连接。
+// 在锁外等待队列有空间，避免阻塞同一个优先级中其他按照策略发送的消息。
+func (t *tcpConn) sendWait(ctx context.Context, m message.Message, final bool) error {
+	level := levelOf(priorityOf(m))
+	for {
+		select {
+		case <-t.stopNotifyChan:
+			return code.ErrConnClosed
+		default:
+		}
+
+		if space := t.sendQueue.waitSpace(level); space != nil {
+			select {
+			case <-space:
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-t.stopNotifyChan:
+				return code.ErrConnClosed
+			}
+			continue
+		}
+		if sent, err := t.trySendWait(ctx, m, level, final); sent || err != nil {
+			return err
+		}
+	}
+}
+
+// trySendWait 在锁内确认队列有空间后打包并入队，队列已满时返回 false
+func (t *tcpConn) trySendWait(ctx context.Context, m message.Message, level int, final bool) (bool, error) {
+	mu := &t.packMu[level]
+	mu.Lock()
+	defer mu.Unlock()
+
+	if t.sendQueue.waitSpace(level) != nil {
+		return false, nil
+	}
+	f, err := t.packFrame(m)
+	if err != nil {
+		return false, err
+	}
+	f.SetFinal(final)
+	// 只有 SendFrame 直接入队的帧会抢占刚才确认的空间，此时很快会有空间
+	if err = t.enqueue(ctx, f); err != nil {
+		f.Release()
+		return false, err
+	}
+	return true, nil
+}
+
+// packFrame 使用连接的 Proto 和 Framer 打包消息
+func (t *tcpConn) packFrame(m message.Message) (*common.Frame, error) {
+	return packFrame(t.Proto, t.cfg.framer, t.bufferPool, m, t.maxSendFrameSize)
+}
 
+// enqueue 阻塞直到写入发送队列、ctx 结束或者连接关闭
+func (t *tcpConn) enqueue(ctx context.Context, f *common.Frame) error {
+	for {
+		select {
+		case <-t.stopNotifyChan:
+			return code.ErrConnClosed
+		default:
+		}
+
+		space := t.sendQueue.pushOrWait(f)
+		if space == nil {
+			return nil
+		}
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.stopNotifyChan:
+			return code.ErrConnClosed
+		}
+	}
+}
+
+// enqueueOrDrop 队列满时丢弃当前的消息
+func (t *tcpConn) enqueueOrDrop(f *common.Frame) error {
+	select {
+	case <-t.stopNotifyChan:
+		return code.ErrConnClosed
+	default:
+	}
+
+	if !t.sendQueue.push(f) {
+		return code.ErrSendQueueFull
+	}
+	return nil
+}
+
+// enqueueDropOldest 队列满时丢弃同一优先级中最早的消息。
+// 分片不会被丢弃，分片本身或者队列中全部是分片时，和 enqueueOrDrop 一样丢弃当前的消息。
+func (t *tcpConn) enqueueDropOldest(f *common.Frame) error {
 	select {
-	case t.sendChan <- msg:
+	case <-t.stopNotifyChan:
+		return code.ErrConnClosed
 	default:
-		return errors.New("send chan is full")
+	}
+
+	old, ok := t.sendQueue.pushDropOldest(f)
+	if old != nil {
+		// TODO log 丢弃最早的消息
+		old.Release()
+	}
+	if !ok {
+		return code.ErrSendQueueFull
 	}
 	return nil
 }
 
+// enqueueOrDisconnect 队列持续满载超过 slowConsumerTimeout 后断开连接
+func (t *tcpConn) enqueueOrDisconnect(f *common.Frame) error {
+	if err := t.enqueueOrDrop(f); !errors.Is(err, code.ErrSendQueueFull) {
+		if err == nil {
+			t.fullSince.Store(0)
+		}
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	if !t.fullSince.CompareAndSwap(0, now) &&
+		now-t.fullSince.Load() >= t.slowConsumerTimeout.Load() {
+		// TODO log
+		t.Stop()
+		return code.ErrSlowConsumer
+	}
+	return code.ErrSendQueueFull
+}
+
 func (t *tcpConn) send() {
 	defer t.Stop()
-	for msg := range t.sendChan {
-		if t.IsStop() {
+
+	var linger *time.Timer
+	if t.cfg.writeLinger > 0 {
+		linger = time.NewTimer(t.cfg.writeLinger)
+		if !linger.Stop() {
+			<-linger.C
+		}
+		defer linger.Stop()
+	}
+
+	frames := make([]*common.Frame, 0, t.cfg.writeBatchNum)
+	batch := make(net.Buffers, 0, t.cfg.writeBatchNum)
+	for {
+		f := t.sendQueue.dequeue(t.stopNotifyChan, nil)
+		if f == nil {
 			return
 		}
 
+		frames = t.collect(append(frames[:0], f), f.Len(), linger)
+
+		batch = batch[:0]
+		for _, frame := range frames {
+			batch = append(batch, frame.Bytes())
+		}
+
+		// WriteTo 会修改切片本身，这里使用副本
+		bufs := batch
 		_ = t.SetWriteDeadline(time.Now().Add(t.cfg.writeTimeout))
-		_, err := t.Write(msg)
-		if err != nil {
+		_, err := bufs.WriteTo(t.TCPConn)
+
+		// 写入完成，释放引用
+		final := false
+		for i, frame := range frames {
+			if frame.Final() {
+				final = true
+			}
+			frame.Release()
+			frames[i] = nil
+			batch[i] = nil
+		}
+
+		if err != nil || final {
 			// TODO LOG
 			return
 		}
+
+		// 队列已经清空，重新计算满载时间
+		if t.sendQueue.len() == 0 {
+			t.fullSince.Store(0)
+		}
 	}
 }
 
+// collect 按照优先级从发送队列中收集当前可以合并写入的帧，
+// 直到达到数量或者大小限制。如果设置了 linger，队列为空时最多等待一次。
+func (t *tcpConn) collect(frames []*common.Frame, size int, linger *time.Timer) []*common.Frame {
+	lingered := linger == nil
+	for len(frames) < t.cfg.writeBatchNum && size < t.cfg.writeBatchSize {
+		if f := t.sendQueue.tryDequeue(); f != nil {
+			frames = append(frames, f)
+			size += f.Len()
+			continue
+		}
+
+		if lingered {
+			return frames
+		}
+		lingered = true
+
+		linger.Reset(t.cfg.writeLinger)
+		f := t.sendQueue.dequeue(t.stopNotifyChan, linger.C)
+		if f == nil {
+			// 等待超时或者连接关闭
+			return frames
+		}
+		frames = append(frames, f)
+		size += f.Len()
+		if !linger.Stop() {
+			<-linger.C
+		}
+	}
+	return frames
+}
+
 func (t *tcpConn) handFunc() {
-	defer t.Stop()
 	go t.recv()
-	for msg := range t.recvChan {
-		if t.IsStop() {
+
+	// 定期清理超时的分片消息
+	expire := time.NewTicker(t.cfg.reassemblyTimeout)
+	defer expire.Stop()
+
+	for {
+		var msg []byte
+		select {
+		case <-t.stopNotifyChan:
 			return
+		case now := <-expire.C:
+			t.reassembler.expire(now)
+			continue
+		case msg = <-t.recvChan:
 		}
 
-		m, _ := t.Unpack(msg)
+		m, err := t.Unpack(msg)
 		// 回收
 		t.bufferPool.Put(msg)
+		if err != nil || m == nil {
+			if err == nil {
+				err = code.ErrNilMessage
+			}
+			// Proto 没有给出具体原因时，视为帧格式错误
+			var pe *code.ProtocolError
+			if !errors.As(err, &pe) {
+				err = code.NewProtocolError(code.ReasonMalformed, err)
+			}
+			t.closeWithReason(err)
+			return
+		}
+
+		// 重组分片消息，完成后再处理
+		if _, ok := m.GetHeader()[message.MsgFragment]; ok {
+			if m, err = t.reassembler.add(m, time.Now()); err != nil {
+				t.closeWithReason(err)
+				return
+			}
+			if m == nil {
+				continue
+			}
+		}
+
+		msgType := message.MsgTypeFromString(m.GetHeader()[message.MsgTypeKey])
+		switch msgType {
+		case message.MsgTypeStream:
+			// 流消息需要按照顺序分发，只有建立流的消息交给处理函数
+			if ctx := t.handleStream(m); ctx != nil {
+				go t.handleFunc(ctx)
+			}
+			continue
+		case message.MsgTypeCancel:
+			// 取消请求不交给处理函数
+			t.inflight.cancel(m.GetHeader()[message.MsgSeq])
+			continue
+		}
 
 		// 检查消息
 		if err := m.Check(); err != nil {
 			// 只有请求的消息才会返回错误
-			if message.MsgTypeFromString(m.GetHeader()[message.MsgTypeKey]) != message.MsgTypeRequest {
+			if msgType != message.MsgTypeRequest {
 				continue
 			}
-			m.SetHeader(message.MsgErr, err.Error())
-			m.SetHeader(message.MsgTypeKey, message.MsgTypeReply.String())
-			m.SetBody(nil)
-			t.SendMsg(m)
+			t.replyError(m, err)
 			continue
 		}
 
-		ctx := NewContext(context.Background(), m, t)
+		if msgType != message.MsgTypeRequest {
+			// 消息处理函数
+			go t.handleFunc(NewContext(context.Background(), m, t))
+			continue
+		}
 
-		// 消息处理函数
-		go t.handleFunc(ctx)
+		// 请求可以被对端取消，超时后上下文结束
+		c, done := t.inflight.add(m.GetHeader()[message.MsgSeq], t.requestDeadline(m, time.Now()))
+		go func(ctx *Context) {
+			defer done()
+			// 已经超时的请求不再处理
+			if ctx.GetCtx().Err() != nil {
+				t.replyError(ctx.reqMsg, code.ErrDeadlineExceeded)
+				return
+			}
+			t.handleFunc(ctx)
+		}(NewContext(c, m, t))
 	}
 }
+
+// requestDeadline 根据对端传递的超时时间和 maxHandlerTimeout 计算请求的截止时间，零值表示不限制
+func (t *tcpConn) requestDeadline(m message.Message, now time.Time) time.Time {
+	var deadline time.Time
+	if t.cfg.maxHandlerTimeout > 0 {
+		deadline = now.Add(t.cfg.maxHandlerTimeout)
+	}
+	if v, ok := m.GetHeader()[message.MsgTimeout]; ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			// TODO log
+			return deadline
+		}
+		if d := now.Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// replyError 使用请求消息回复错误
+func (t *tcpConn) replyError(m message.Message, err error) {
+	message.SetError(m, err)
+	m.SetHeader(message.MsgTypeKey, message.MsgTypeReply.String())
+	m.SetBody(nil)
+	// TODO log 发送失败
+	_ = t.SendMsg(m)
+}
+
+// packFrame 打包消息并划分为帧，数据从 pool 中分配，负载超过 maxSize 时返回 code.ErrFrameTooLarge。
+// 如果 Proto 和 Framer 都支持，负载直接写在预留的帧头之后，不需要拷贝。
+// Proto 实现了 proto.LanePacker 时，使用帧所在的发送队列作为 lane，见 levelOf。
+func packFrame(p proto.Proto, f proto.Framer, pool *common.LimitedPool, m message.Message, maxSize uint32) (*common.Frame, error) {
+	var (
+		buf     []byte
+		prefix  int
+		payload []byte
+		err     error
+	)
+	pf, direct := f.(proto.PrefixFramer)
+	if direct {
+		prefix = pf.PrefixSize()
+	}
+	priority := priorityOf(m)
+	_, fragment := m.GetHeader()[message.MsgFragment]
+	alloc := func(size int) []byte {
+		buf = pool.Get(prefix + size)
+		return buf[prefix:]
+	}
+	if lp, ok := p.(proto.LanePacker); ok {
+		payload, err = lp.PackLaneWith(m, uint8(levelOf(priority)), alloc)
+	} else if pp, ok := p.(proto.PoolPacker); ok {
+		payload, err = pp.PackWith(m, alloc)
+	} else {
+		payload, err = p.Pack(m)
+	}
+	if err == nil && uint32(len(payload)) > maxSize {
+		err = fmt.Errorf("%w: %d > %d", code.ErrFrameTooLarge, len(payload), maxSize)
+	}
+	if err != nil {
+		if buf != nil {
+			pool.Put(buf)
+		}
+		return nil, err
+	}
+
+	// Proto 可能重新分配了负载，例如追加数据超过了容量
+	if direct && buf != nil && len(payload) > 0 && cap(buf) >= prefix+len(payload) &&
+		&buf[prefix:cap(buf)][0] == &payload[0] {
+		buf = buf[:prefix+len(payload)]
+		if err = pf.PutPrefix(buf[:prefix], len(payload)); err != nil {
+			pool.Put(buf)
+			return nil, err
+		}
+	} else {
+		w := frameWriter{buf: pool.Get(prefix + len(payload))[:0]}
+		err = f.WriteFrame(&w, payload)
+		if buf != nil {
+			pool.Put(buf)
+		}
+		if err != nil {
+			pool.Put(w.buf)
+			return nil, err
+		}
+		buf = w.buf
+	}
+
+	frame := common.NewFrame(buf, pool)
+	frame.SetPriority(int8(priority))
+	frame.SetFragment(fragment)
+	return frame, nil
+}
+
+// priorityOf 返回消息的发送优先级，没有设置 message.MsgPriority 时，
+// 错误、心跳和流的额度消息为高优先级，其他为普通优先级。
+// 流的建立、数据、结束和取消消息需要保持顺序，总是使用普通优先级，
+// 否则取消的消息可能早于建立流的消息到达对端。
+func priorityOf(m message.Message) message.Priority {
+	header := m.GetHeader()
+	msgType := message.MsgTypeFromString(header[message.MsgTypeKey])
+	if msgType == message.MsgTypeStream {
+		switch header[message.MsgStreamOp] {
+		case streamOpCredit:
+			return message.PriorityHigh
+		default:
+			return message.PriorityNormal
+		}
+	}
+
+	if p, ok := header[message.MsgPriority]; ok {
+		return message.PriorityFromString(p)
+	}
+	switch msgType {
+	case message.MsgTypeError, message.MsgTypeHeartBeat, message.MsgTypeCancel:
+		return message.PriorityHigh
+	default:
+		return message.PriorityNormal
+	}
+}
+
+// frameWriter 将 Framer 写入的数据追加到 buf 中
+type frameWriter struct {
+	buf []byte
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
@@ -0,0 +1,629 @@
+package spider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ywanbing/spider/code"
+	"github.com/ywanbing/spider/message"
+	"github.com/ywanbing/spider/proto"
+)
+
+// newTestTCPPair 创建一对本地回环的 tcp 连接
+func newTestTCPPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func newTestMsg(i byte) message.Message {
+	return message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypePush.String(),
+	}, []byte{i})
+}
+
+func TestTcpConn_SlowConsumerPolicy(t *testing.T) {
+	c, _ := newTestTCPPair(t)
+	// 不调用 Start，发送队列不会被消费
+	conn := NewTcpConn(c, defaultConnConfig, func(ctx *Context) {}).(*tcpConn)
+	conn.sendQueue = newSendQueue(1, 0)
+
+	if err := conn.SendMsg(newTestMsg(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// DropNewest
+	if err := conn.SendMsg(newTestMsg(2)); !errors.Is(err, code.ErrSendQueueFull) {
+		t.Fatalf("drop newest: got %v", err)
+	}
+
+	// DropOldest
+	conn.SetSlowConsumerPolicy(SlowConsumerDropOldest, 0)
+	if err := conn.SendMsg(newTestMsg(3)); err != nil {
+		t.Fatalf("drop oldest: got %v", err)
+	}
+	m, _ := conn.Unpack(conn.sendQueue.tryDequeue().Bytes()[4:])
+	if m.GetBody()[0] != 3 {
+		t.Fatalf("drop oldest: want newest message left, got %d", m.GetBody()[0])
+	}
+	_ = conn.SendMsg(newTestMsg(4))
+
+	// SendMsgCtx
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := conn.SendMsgCtx(ctx, newTestMsg(5)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("send ctx: got %v", err)
+	}
+
+	// Disconnect
+	conn.SetSlowConsumerPolicy(SlowConsumerDisconnect, 20*time.Millisecond)
+	if err := conn.SendMsg(newTestMsg(6)); !errors.Is(err, code.ErrSendQueueFull) {
+		t.Fatalf("disconnect: got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := conn.SendMsg(newTestMsg(7)); !errors.Is(err, code.ErrSlowConsumer) {
+		t.Fatalf("disconnect: got %v", err)
+	}
+	if !conn.IsStop() {
+		t.Fatal("disconnect: connection should be stopped")
+	}
+
+	// 连接关闭后，阻塞的发送需要返回
+	if err := conn.SendMsgCtx(context.Background(), newTestMsg(8)); !errors.Is(err, code.ErrConnClosed) {
+		t.Fatalf("closed: got %v", err)
+	}
+}
+
+func TestTcpConn_SlowConsumerBlock(t *testing.T) {
+	c, _ := newTestTCPPair(t)
+	conn := NewTcpConn(c, defaultConnConfig, func(ctx *Context) {}).(*tcpConn)
+	conn.sendQueue = newSendQueue(1, 0)
+	conn.SetSlowConsumerPolicy(SlowConsumerBlock, 0)
+
+	_ = conn.SendMsg(newTestMsg(1))
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.SendMsg(newTestMsg(2))
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("block: returned early with %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	conn.sendQueue.tryDequeue()
+	if err := <-done; err != nil {
+		t.Fatalf("block: got %v", err)
+	}
+}
+
+func TestTcpConn_WriteBatch(t *testing.T) {
+	c, s := newTestTCPPair(t)
+	cfg := WithWriteBatch(8, 1024, time.Millisecond)(defaultConnConfig)
+	conn := NewTcpConn(c, cfg, func(ctx *Context) {})
+	conn.Start()
+	defer conn.Close()
+
+	recv := make(chan message.Message, 100)
+	peer := NewTcpConn(s, defaultConnConfig, func(ctx *Context) {
+		recv <- ctx.GetReqMsg()
+	})
+	peer.Start()
+	defer peer.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := conn.SendMsgCtx(context.Background(), newTestMsg(byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make(map[byte]bool)
+	for i := 0; i < 100; i++ {
+		select {
+		case m := <-recv:
+			got[m.GetBody()[0]] = true
+		case <-time.After(time.Second):
+			t.Fatalf("recv timeout, got %d messages", len(got))
+		}
+	}
+	if len(got) != 100 {
+		t.Fatalf("want 100 distinct messages, got %d", len(got))
+	}
+}
+
+func benchmarkTcpConnSend(b *testing.B, opts ...ConnConfigOption) {
+	c, s := newTestTCPPair(b)
+	// 对端收到 b.N 个帧后才停止计时，避免只统计入队的速度
+	done := make(chan struct{})
+	go func() {
+		r := bufio.NewReaderSize(s, 64*1024)
+		framer := proto.NewDefaultFramer()
+		for i := 0; i < b.N; i++ {
+			if _, err := framer.ReadFrame(r); err != nil {
+				return
+			}
+		}
+		close(done)
+	}()
+
+	cfg := defaultConnConfig
+	for _, opt := range opts {
+		cfg = opt(cfg)
+	}
+	conn := NewTcpConn(c, cfg, func(ctx *Context) {})
+	conn.Start()
+	defer conn.Close()
+
+	msg := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypePush.String(),
+	}, make([]byte, 128))
+	frame, _ := conn.Pack(msg)
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		if err := conn.SendMsgCtx(ctx, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		b.Fatal("recv timeout")
+	}
+	b.StopTimer()
+}
+
+// BenchmarkTcpConn_Send 对比逐条写入和合并写入的吞吐量
+func BenchmarkTcpConn_Send(b *testing.B) {
+	b.Run("single", func(b *testing.B) {
+		benchmarkTcpConnSend(b, WithWriteBatch(1, 1, 0))
+	})
+	b.Run("batch", func(b *testing.B) {
+		benchmarkTcpConnSend(b)
+	})
+	b.Run("batch-linger", func(b *testing.B) {
+		benchmarkTcpConnSend(b, WithWriteBatch(0, 0, 50*time.Microsecond))
+	})
+}
+
+func TestTcpConn_ProtocolError(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   uint32
+		reason string
+	}{
+		{"too-large", 0xFFFFFFFF, code.ReasonFrameTooLarge},
+		{"too-small", 3, code.ReasonFrameTooSmall},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := newTestTCPPair(t)
+			metrics := NewCounterMetrics()
+			cfg := defaultConnConfig
+			for _, opt := range []ConnConfigOption{WithMetrics(metrics), WithProtocolErrorFrame(true)} {
+				cfg = opt(cfg)
+			}
+			conn := NewTcpConn(s, cfg, func(ctx *Context) {})
+			conn.Start()
+
+			recv := make(chan message.Message, 1)
+			peer := NewTcpConn(c, defaultConnConfig, func(ctx *Context) {
+				recv <- ctx.GetReqMsg()
+			})
+			peer.Start()
+
+			_, _ = c.Write([]byte{byte(tt.size >> 24), byte(tt.size >> 16), byte(tt.size >> 8), byte(tt.size)})
+
+			select {
+			case m := <-recv:
+				if message.MsgTypeFromString(m.GetHeader()[message.MsgTypeKey]) != message.MsgTypeError {
+					t.Fatalf("want error frame, got %v", m.GetHeader())
+				}
+			case <-time.After(time.Second):
+				t.Fatal("error frame timeout")
+			}
+
+			select {
+			case <-conn.StopNotifyChan():
+			case <-time.After(time.Second):
+				t.Fatal("connection should be closed")
+			}
+
+			var pe *code.ProtocolError
+			if !errors.As(conn.CloseReason(), &pe) || pe.Reason != tt.reason {
+				t.Fatalf("close reason: got %v", conn.CloseReason())
+			}
+			if metrics.ProtocolErrors()[tt.reason] != 1 {
+				t.Fatalf("metrics: got %v", metrics.ProtocolErrors())
+			}
+		})
+	}
+}
+
+func TestTcpConn_Handshake(t *testing.T) {
+	c, s := newTestTCPPair(t)
+	cfg := WithMaxFrameSize(1024)(WithHandshake()(defaultConnConfig))
+	client := NewTcpConn(c, cfg, func(ctx *Context) {})
+	server := NewTcpConn(s, WithHandshake()(defaultConnConfig), func(ctx *Context) {})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Handshake()
+	}()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conn := range []TcpConn{client, server} {
+		n := conn.Negotiated()
+		if n == nil || n.Version != proto.ProtoVersion || n.MaxFrameSize != 1024 {
+			t.Fatalf("negotiated: got %+v", n)
+		}
+	}
+
+	// 协商后，超过对端最大帧长度的消息不能发送
+	msg := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypePush.String(),
+	}, make([]byte, 2048))
+	if err := server.SendMsg(msg); !errors.Is(err, code.ErrFrameTooLarge) {
+		t.Fatalf("want ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestTcpConn_ChecksumMismatch(t *testing.T) {
+	c, s := newTestTCPPair(t)
+	metrics := NewCounterMetrics()
+	cfg := WithMetrics(metrics)(WithProto(proto.NewChecksumProto(proto.NewRawProto()))(defaultConnConfig))
+	conn := NewTcpConn(s, cfg, func(ctx *Context) {})
+	conn.Start()
+
+	data, _ := conn.Pack(newTestMsg(1))
+	data[len(data)-1] ^= 0xff
+	_ = proto.NewDefaultFramer().WriteFrame(c, data)
+
+	select {
+	case <-conn.StopNotifyChan():
+	case <-time.After(time.Second):
+		t.Fatal("connection should be closed")
+	}
+	if !errors.Is(conn.CloseReason(), code.ErrChecksumMismatch) {
+		t.Fatalf("close reason: got %v", conn.CloseReason())
+	}
+	if metrics.ProtocolErrors()[code.ReasonChecksum] != 1 {
+		t.Fatalf("metrics: got %v", metrics.ProtocolErrors())
+	}
+}
+
+func TestTcpConn_Framer(t *testing.T) {
+	framers := map[string]proto.Framer{
+		"length-2-le": proto.NewLengthFramer(2, binary.LittleEndian, false),
+		"uvarint":     proto.NewUvarintFramer(),
+	}
+	for name, framer := range framers {
+		t.Run(name, func(t *testing.T) {
+			c, s := newTestTCPPair(t)
+			cfg := WithFramer(framer)(defaultConnConfig)
+			conn := NewTcpConn(c, cfg, func(ctx *Context) {})
+			conn.Start()
+			defer conn.Close()
+
+			recv := make(chan message.Message, 10)
+			peer := NewTcpConn(s, cfg, func(ctx *Context) {
+				recv <- ctx.GetReqMsg()
+			})
+			peer.Start()
+			defer peer.Close()
+
+			for i := 0; i < 10; i++ {
+				if err := conn.SendMsgCtx(context.Background(), newTestMsg(byte(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := make(map[byte]bool)
+			for i := 0; i < 10; i++ {
+				select {
+				case m := <-recv:
+					got[m.GetBody()[0]] = true
+				case <-time.After(time.Second):
+					t.Fatal("recv timeout")
+				}
+			}
+			if len(got) != 10 {
+				t.Fatalf("want 10 distinct messages, got %d", len(got))
+			}
+		})
+	}
+}
+
+func TestTcpConn_Fragmentation(t *testing.T) {
+	c, s := newTestTCPPair(t)
+	conn := NewTcpConn(c, WithFragmentation(1024)(defaultConnConfig), func(ctx *Context) {})
+	conn.Start()
+	defer conn.Close()
+
+	recv := make(chan message.Message, 10)
+	peer := NewTcpConn(s, WithMaxFrameSize(2048)(defaultConnConfig), func(ctx *Context) {
+		recv <- ctx.GetReqMsg()
+	})
+	peer.Start()
+	defer peer.Close()
+
+	body := make([]byte, 100*1024)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	big := message.NewMessage(1, 'R', map[string]string{
+		message.MsgTypeKey: message.MsgTypePush.String(),
+		"key":              "value",
+	}, body)
+
+	// 分片之间穿插其他的消息
+	errs := make(chan error, 1)
+	go func() {
+		errs <- conn.SendMsgCtx(context.Background(), big)
+	}()
+	for i := 0; i < 5; i++ {
+		if err := conn.SendMsgCtx(context.Background(), newTestMsg(byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		select {
+		case m := <-recv:
+			if len(m.GetBody()) == 1 {
+				continue
+			}
+			if !bytes.Equal(m.GetBody(), body) || m.GetHeader()["key"] != "value" {
+				t.Fatal("reassembled message mismatch")
+			}
+			if _, ok := m.GetHeader()[message.MsgFragment]; ok {
+				t.Fatal("fragment header should be removed")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("recv timeout")
+		}
+	}
+}
+
+func TestTcpConn_EncryptedPriority(t *testing.T) {
+	protos := map[string]func() proto.Proto{
+		"encrypted": func() proto.Proto {
+			return proto.NewEncryptedProto(proto.NewRawProto(), proto.CipherAES256GCM)
+		},
+		// 包装加密的 Proto 需要把 lane 传递给 base
+		"checksum-over-encrypted": func() proto.Proto {
+			return proto.NewChecksumProto(proto.NewEncryptedProto(proto.NewRawProto(), proto.CipherAES256GCM))
+		},
+		"chain-over-encrypted": func() proto.Proto {
+			return proto.Chain(proto.NewEncryptedProto(proto.NewRawProto(), proto.CipherAES256GCM), proto.NewChecksumTransform())
+		},
+	}
+	for name, newProto := range protos {
+		t.Run(name, func(t *testing.T) {
+			testEncryptedPriority(t, newProto())
+		})
+	}
+}
+
+func testEncryptedPriority(t *testing.T, p proto.Proto) {
+	c, s := newTestTCPPair(t)
+	cfg := WithHandshake()(WithProto(p)(defaultConnConfig))
+
+	recv := make(chan message.Message, 200)
+	conn := NewTcpConn(c, cfg, func(ctx *Context) {})
+	peer := NewTcpConn(s, cfg, func(ctx *Context) {
+		recv <- ctx.GetReqMsg()
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- peer.Handshake()
+	}()
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// 发送协程启动前积压超过重放窗口的普通消息，高优先级的消息先发送
+	const backlog = 100
+	for i := 0; i < backlog; i++ {
+		if err := conn.SendMsg(newTestMsg(byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	high := newTestMsg(backlog)
+	high.SetHeader(message.MsgPriority, message.PriorityHigh.String())
+	if err := conn.SendMsg(high); err != nil {
+		t.Fatal(err)
+	}
+
+	peer.Start()
+	defer peer.Close()
+	conn.Start()
+	defer conn.Close()
+
+	for i := 0; i <= backlog; i++ {
+		select {
+		case <-recv:
+		case <-peer.StopNotifyChan():
+			t.Fatalf("peer closed: %v", peer.CloseReason())
+		case <-time.After(time.Second):
+			t.Fatal("recv timeout")
+		}
+	}
+}
+
+// pausedProto 打包 body 为 0xfe 的消息后阻塞，直到 release 被关闭
+type pausedProto struct {
+	proto.Proto
+	packed  chan struct{}
+	release chan struct{}
+}
+
+func (p *pausedProto) PackLaneWith(m message.Message, lane uint8, alloc func(size int) []byte) ([]byte, error) {
+	b, err := p.Proto.(proto.LanePacker).PackLaneWith(m, lane, alloc)
+	if m.GetBody()[0] == 0xfe {
+		close(p.packed)
+		<-p.release
+	}
+	return b, err
+}
+
+func TestTcpConn_EncryptedConcurrent(t *testing.T) {
+	c, s := newTestTCPPair(t)
+	cfg := WithHandshake()(WithProto(proto.NewEncryptedProto(proto.NewRawProto(), proto.CipherAES256GCM))(defaultConnConfig))
+
+	done := make(chan struct{})
+	conn := NewTcpConn(c, cfg, func(ctx *Context) {}).(*tcpConn)
+	peer := NewTcpConn(s, cfg, func(ctx *Context) {
+		if ctx.GetReqMsg().GetBody()[0] == 0xff {
+			close(done)
+		}
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- peer.Handshake()
+	}()
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	paused := &pausedProto{Proto: conn.Proto, packed: make(chan struct{}), release: make(chan struct{})}
+	conn.Proto = paused
+	peer.Start()
+	defer peer.Close()
+	conn.Start()
+	defer conn.Close()
+
+	// 一个协程分配计数器后暂停，其他协程发送超过重放窗口的消息，
+	// 入队的顺序仍然和计数器的顺序一致，对端不会当作重放
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = conn.SendMsg(newTestMsg(0xfe))
+	}()
+	<-paused.packed
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = conn.SendMsg(newTestMsg(byte(i)))
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(paused.release)
+	wg.Wait()
+
+	if err := conn.SendMsg(newTestMsg(0xff)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-peer.StopNotifyChan():
+		t.Fatalf("peer closed: %v", peer.CloseReason())
+	case <-time.After(3 * time.Second):
+		t.Fatal("recv timeout")
+	}
+}
+
+func TestTcpConn_DropOldestFragment(t *testing.T) {
+	c, s := newTestTCPPair(t)
+	conn := NewTcpConn(c, WithFragmentation(10)(defaultConnConfig), func(ctx *Context) {}).(*tcpConn)
+	conn.sendQueue = newSendQueue(3, 0)
+	conn.SetSlowConsumerPolicy(SlowConsumerDropOldest, 0)
+
+	recv := make(chan message.Message, 10)
+	peer := NewTcpConn(s, defaultConnConfig, func(ctx *Context) {
+		recv <- ctx.GetReqMsg()
+	})
+	peer.Start()
+	defer peer.Close()
+
+	// 发送协程启动前，分片和普通的消息占满队列
+	if err := conn.SendMsg(newTestMsg(0)); err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.Repeat([]byte("spider"), 5)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- conn.SendMsg(message.NewMessage(1, 'R', map[string]string{
+			message.MsgTypeKey: message.MsgTypePush.String(),
+		}, body))
+	}()
+	for conn.sendQueue.len() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 丢弃最早的消息时跳过分片
+	for i := 1; i < 5; i++ {
+		if err := conn.SendMsg(newTestMsg(byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Start()
+	defer conn.Close()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		select {
+		case m := <-recv:
+			if len(m.GetBody()) == 1 {
+				continue
+			}
+			if !bytes.Equal(m.GetBody(), body) {
+				t.Fatal("reassembled message mismatch")
+			}
+			return
+		case <-peer.StopNotifyChan():
+			t.Fatalf("peer closed: %v", peer.CloseReason())
+		case <-time.After(time.Second):
+			t.Fatal("recv timeout")
+		}
+	}
+}
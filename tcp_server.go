@@ -6,6 +6,7 @@ import (
 	"net"
 	"sync"
 
+	"github.com/ywanbing/spider/code"
 	"github.com/ywanbing/spider/common"
 	"github.com/ywanbing/spider/message"
 )
@@ -22,6 +23,9 @@ type TcpServer struct {
 
 	listener net.Listener
 
+	// 广播消息使用的缓存池
+	bufferPool *common.LimitedPool
+
 	close chan struct{}
 }
 
@@ -37,6 +41,7 @@ func NewTcpX(cfgOptions ...ConnConfigOption) *TcpServer {
 		connMap:       make(map[uint64]TcpConn),
 		addConnChan:   make(chan TcpConn, 10),
 		closeConnChan: make(chan TcpConn, 10),
+		bufferPool:    common.NewLimitedPool(cfg.binaryPoolMinSize, cfg.binaryPoolMaxSize),
 		close:         make(chan struct{}),
 	}
 }
@@ -91,6 +96,13 @@ func (t *TcpServer) listenAndServeTCP(network, addr string) error {
 
 // handleConn 处理连接
 func (t *TcpServer) handleConn(conn TcpConn) {
+	// 前导协商
+	if err := conn.Handshake(); err != nil {
+		// TODO log
+		_ = conn.Close()
+		return
+	}
+
 	// 前置检查
 	if !t.cfg.onConnHandle(conn) {
 		_ = conn.Close()
@@ -158,6 +170,58 @@ func (t *TcpServer) IsClosed() bool {
 	}
 }
 
+// Broadcast 向所有连接推送消息。
+// 使用默认 Proto 的连接共享同一个帧，消息只打包一次，最后一个连接写入完成后归还到缓存池；
+// 协商后使用专用 Proto 的连接（例如加密）和需要分片的消息单独打包。
+// 每个连接按照自己的 SlowConsumerPolicy 处理发送队列满的情况。
+func (t *TcpServer) Broadcast(msg message.Message) error {
+	msg.SetHeader(message.MsgTypeKey, message.MsgTypePush.String())
+
+	var f *common.Frame
+	defer func() {
+		if f != nil {
+			f.Release()
+		}
+	}()
+
+	// 发送时不持有锁，避免阻塞连接的建立和关闭
+	t.connMapLock.RLock()
+	conns := make([]TcpConn, 0, len(t.connMap))
+	for _, conn := range t.connMap {
+		conns = append(conns, conn)
+	}
+	t.connMapLock.RUnlock()
+
+	for _, conn := range conns {
+		if !usesDefaultProto(conn) || t.cfg.fragmentSize > 0 && len(msg.GetBody()) > t.cfg.fragmentSize {
+			// TODO log 发送失败
+			_ = conn.SendMsg(msg)
+			continue
+		}
+
+		if f == nil {
+			var err error
+			if f, err = t.packFrame(msg); err != nil {
+				return err
+			}
+		}
+		// TODO log 发送失败
+		_ = conn.SendFrame(f.Retain())
+	}
+	return nil
+}
+
+// usesDefaultProto 连接是否使用服务器默认的 Proto，在前导协商完成后确定，不比较 Proto 的值
+func usesDefaultProto(conn TcpConn) bool {
+	c, ok := conn.(interface{ usesDefaultProto() bool })
+	return ok && c.usesDefaultProto()
+}
+
+// packFrame 使用默认的 Proto 打包广播的消息
+func (t *TcpServer) packFrame(msg message.Message) (*common.Frame, error) {
+	return packFrame(t.cfg.p, t.cfg.framer, t.bufferPool, msg, t.cfg.maxFrameSize)
+}
+
 // RegisterGlobalMiddle add global routing middle handlers.
 func (t *TcpServer) RegisterGlobalMiddle(middles ...func(ctx *Context)) {
 	t.mux.RegisterGlobalMiddle(middles...)
@@ -173,6 +237,16 @@ func (t *TcpServer) RegisterHandler(id modelID, subID subMsgID, handler func(ctx
 	t.mux.RegisterHandler(id, subID, handler, middles...)
 }
 
+// RegisterStreamHandler add stream handlers by modelID and subMsgID.
+func (t *TcpServer) RegisterStreamHandler(id modelID, subID subMsgID, handler StreamHandler, middles ...func(ctx *Context)) {
+	t.mux.RegisterStreamHandler(id, subID, handler, middles...)
+}
+
+// SetNotFound sets the handler called when no request route matches.
+func (t *TcpServer) SetNotFound(handler func(ctx *Context)) {
+	t.mux.SetNotFound(handler)
+}
+
 // handleMessage 服务器处理消息
 func (t *TcpServer) handleMessage(ctx *Context) {
 	header := ctx.reqMsg.GetHeader()
@@ -181,6 +255,9 @@ func (t *TcpServer) handleMessage(ctx *Context) {
 		fmt.Printf("recv request msg: %s", string(ctx.reqMsg.GetBody()))
 		// 请求消息
 		t.HandleRequest(ctx)
+	case message.MsgTypeStream:
+		// 建立流
+		t.HandleStream(ctx)
 	case message.MsgTypeHeartBeat:
 		// 心跳消息
 		t.HandleHeartBeat(ctx)
@@ -189,24 +266,42 @@ func (t *TcpServer) handleMessage(ctx *Context) {
 	}
 }
 
-// HandleRequest 处理请求消息
-func (t *TcpServer) HandleRequest(ctx *Context) {
+// HandleStream 处理建立流的消息，没有对应的流处理函数时结束流
+func (t *TcpServer) HandleStream(ctx *Context) {
 	msgId := ctx.reqMsg.GetMsgId()
 	modelId := common.GetModelId(msgId)
 	subMsgId := common.GetSubMsgId(msgId)
 
 	handler, ok := t.mux.Handlers[modelId]
-	if !ok {
+	if !ok || !handler.Streams[subMsgId] {
 		// TODO: log
+		ctx.Stream().finish(code.ErrStreamNotFound)
 		return
 	}
+	// 中间件没有调用处理函数时结束流，处理函数已经结束流时忽略
+	defer ctx.Stream().finish(code.ErrStreamAborted)
+	t.runHandlers(ctx, handler, subMsgId)
+}
 
-	f, ok := handler.Handlers[subMsgId]
-	if !ok {
+// HandleRequest 处理请求消息
+func (t *TcpServer) HandleRequest(ctx *Context) {
+	msgId := ctx.reqMsg.GetMsgId()
+	modelId := common.GetModelId(msgId)
+	subMsgId := common.GetSubMsgId(msgId)
+
+	handler, ok := t.mux.Handlers[modelId]
+	if !ok || handler.Handlers[subMsgId] == nil {
+		if t.mux.NotFound != nil {
+			t.mux.NotFound(ctx)
+		}
 		// TODO: log
 		return
 	}
+	t.runHandlers(ctx, handler, subMsgId)
+}
 
+// runHandlers 按照 全局中间件、模块中间件、消息中间件、处理函数 的顺序执行
+func (t *TcpServer) runHandlers(ctx *Context, handler *MsgMiddleHandler, subMsgId subMsgID) {
 	if ctx.handlers == nil {
 		ctx.handlers = make([]func(c *Context), 0, 10)
 	}
@@ -222,7 +317,7 @@ func (t *TcpServer) HandleRequest(ctx *Context) {
 	}
 
 	// handler
-	ctx.handlers = append(ctx.handlers, f)
+	ctx.handlers = append(ctx.handlers, handler.Handlers[subMsgId])
 
 	// 执行
 	if len(ctx.handlers) > 0 {